@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// adaptiveSteps is the number of healthy intervals the adaptive throttle
+// takes to climb from the floor to the ceiling
+const adaptiveSteps = 20
+
+// adaptiveThrottle tunes the points per second of a rate limiter from the
+// backpressure of the destinations, AIMD style: the rate grows by a fixed
+// step after every interval of fast and successful writes, and is halved
+// when writes fail, are slower than the target latency on average or the
+// carbon cache grows above its limit.
+type adaptiveThrottle struct {
+	limiter       *rateLimiter
+	floor         float64
+	ceiling       float64
+	rate          float64
+	targetLatency time.Duration
+	cacheSize     func() (float64, error)
+	cacheLimit    float64
+
+	lock    sync.Mutex
+	writes  int
+	errors  int
+	latency time.Duration
+}
+
+// newAdaptiveThrottle starts the limiter at the initial rate, clamped between
+// floor and ceiling points per second
+func newAdaptiveThrottle(limiter *rateLimiter, floor float64, ceiling float64, initial float64, targetLatency time.Duration) (*adaptiveThrottle, error) {
+	if floor <= 0 || ceiling < floor {
+		return nil, fmt.Errorf("invalid adaptive range %v-%v points per second", floor, ceiling)
+	}
+	if targetLatency <= 0 {
+		return nil, errors.New("the adaptive target latency must be positive")
+	}
+	throttle := &adaptiveThrottle{
+		limiter:       limiter,
+		floor:         floor,
+		ceiling:       ceiling,
+		rate:          min(max(initial, floor), ceiling),
+		targetLatency: targetLatency,
+	}
+	limiter.setPointsPerSecond(throttle.rate)
+	return throttle, nil
+}
+
+// observe records the outcome of one write
+func (throttle *adaptiveThrottle) observe(latency time.Duration, err error) {
+	throttle.lock.Lock()
+	defer throttle.lock.Unlock()
+
+	throttle.writes++
+	throttle.latency += latency
+	if err != nil {
+		throttle.errors++
+	}
+}
+
+// congestion returns why the destinations are falling behind since the last
+// adjustment, or an empty string
+func (throttle *adaptiveThrottle) congestion() string {
+	throttle.lock.Lock()
+	writes, failed, latency := throttle.writes, throttle.errors, throttle.latency
+	throttle.writes, throttle.errors, throttle.latency = 0, 0, 0
+	throttle.lock.Unlock()
+
+	if failed > 0 {
+		return fmt.Sprintf("%d failed writes", failed)
+	}
+	if writes > 0 {
+		if average := latency / time.Duration(writes); average > throttle.targetLatency {
+			return fmt.Sprintf("average write latency %v", average.Round(time.Millisecond))
+		}
+	}
+	if throttle.cacheSize != nil {
+		size, err := throttle.cacheSize()
+		if err != nil {
+			log.Printf("Failed to read the carbon cache size: %v", err)
+		} else if size > throttle.cacheLimit {
+			return fmt.Sprintf("carbon cache size %.0f", size)
+		}
+	}
+	return ""
+}
+
+// adjust applies one AIMD step and returns the new rate
+func (throttle *adaptiveThrottle) adjust() float64 {
+	if reason := throttle.congestion(); reason != "" {
+		rate := max(throttle.rate/2, throttle.floor)
+		if rate != throttle.rate {
+			log.Printf("Adaptive throttling: %s, slowing down to %.0f points/s", reason, rate)
+		}
+		throttle.rate = rate
+	} else {
+		throttle.rate = min(throttle.rate+max((throttle.ceiling-throttle.floor)/adaptiveSteps, 1), throttle.ceiling)
+	}
+	throttle.limiter.setPointsPerSecond(throttle.rate)
+	return throttle.rate
+}
+
+// run adjusts the rate every interval, forever
+func (throttle *adaptiveThrottle) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		throttle.adjust()
+	}
+}
+
+// throttledSender reports the latency and the outcome of every write of the
+// wrapped Sender to the adaptive throttle
+type throttledSender struct {
+	Sender
+	throttle *adaptiveThrottle
+}
+
+func (sender *throttledSender) SendMetrics(metrics []Metric) error {
+	start := time.Now()
+	err := sender.Sender.SendMetrics(metrics)
+	sender.throttle.observe(time.Since(start), err)
+	return err
+}
+
+// newCacheSizeReader returns a function reading the carbon cache size from
+// source. A http(s) URL is queried as a graphite-web render API returning
+// JSON, any other source is the whisper file carbon writes its
+// cache.size metric to.
+func newCacheSizeReader(source string) func() (float64, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 5 * time.Second}
+		return func() (float64, error) {
+			return readCacheSizeRender(client, source)
+		}
+	}
+	return func() (float64, error) {
+		return readCacheSizeWhisper(source)
+	}
+}
+
+// readCacheSizeWhisper returns the latest value of a whisper file
+func readCacheSizeWhisper(path string) (float64, error) {
+	whisperData, err := whisper.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer whisperData.Close()
+
+	now := int(whisper.Now().Unix())
+	timeSeries, err := whisperData.Fetch(now-600, now)
+	if err != nil {
+		return 0, err
+	}
+	if timeSeries != nil {
+		values := timeSeries.Values()
+		for i := len(values) - 1; i >= 0; i-- {
+			if !math.IsNaN(values[i]) {
+				return values[i], nil
+			}
+		}
+	}
+	return 0, errors.New("no recent cache size in " + path)
+}
+
+// readCacheSizeRender returns the largest of the latest values of every
+// series returned by a graphite-web render query, so that a wildcard target
+// covers every carbon-cache instance
+func readCacheSizeRender(client *http.Client, url string) (float64, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("render request failed with status %s", response.Status)
+	}
+
+	var series []struct {
+		Target     string        `json:"target"`
+		Datapoints [][2]*float64 `json:"datapoints"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&series); err != nil {
+		return 0, err
+	}
+
+	size, found := 0.0, false
+	for _, s := range series {
+		for i := len(s.Datapoints) - 1; i >= 0; i-- {
+			if value := s.Datapoints[i][0]; value != nil {
+				size, found = max(size, *value), true
+				break
+			}
+		}
+	}
+	if !found {
+		return 0, errors.New("no recent cache size returned by " + url)
+	}
+	return size, nil
+}
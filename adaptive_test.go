@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+func TestNewAdaptiveThrottle(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		floor, ceiling, initial float64
+		latency                 time.Duration
+		want                    float64
+		wantErr                 bool
+	}{
+		{100, 1000, 0, time.Second, 100, false},
+		{100, 1000, 500, time.Second, 500, false},
+		{100, 1000, 5000, time.Second, 1000, false},
+		{0, 1000, 0, time.Second, 0, true},
+		{1000, 100, 0, time.Second, 0, true},
+		{100, 1000, 0, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		limiter := newRateLimiter(0, 0, time.Second)
+		throttle, err := newAdaptiveThrottle(limiter, tt.floor, tt.ceiling, tt.initial, tt.latency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newAdaptiveThrottle(%v, %v, %v) error = %v, wantErr %v", tt.floor, tt.ceiling, tt.initial, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if throttle.rate != tt.want || !limiter.enabled || limiter.points.rate != tt.want {
+			t.Errorf("newAdaptiveThrottle(%v, %v, %v) started at %v, limiter %+v, want %v", tt.floor, tt.ceiling, tt.initial, throttle.rate, limiter.points, tt.want)
+		}
+	}
+}
+
+func TestAdaptiveThrottleAdjust(t *testing.T) {
+	t.Parallel()
+
+	limiter := newRateLimiter(0, 0, time.Second)
+	throttle, err := newAdaptiveThrottle(limiter, 100, 2100, 100, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("newAdaptiveThrottle() error = %v", err)
+	}
+
+	steps := []struct {
+		name    string
+		latency time.Duration
+		err     error
+		want    float64
+	}{
+		{"idle", 0, nil, 200},
+		{"fast", 10 * time.Millisecond, nil, 300},
+		{"slow", time.Second, nil, 150},
+		{"failed", 0, errors.New("broken pipe"), 100},
+		{"floor", 0, errors.New("broken pipe"), 100},
+	}
+
+	for _, step := range steps {
+		if step.name != "idle" {
+			throttle.observe(step.latency, step.err)
+		}
+		if got := throttle.adjust(); got != step.want {
+			t.Errorf("%s: adjust() = %v, want %v", step.name, got, step.want)
+		}
+		if limiter.points.rate != step.want {
+			t.Errorf("%s: limiter rate = %v, want %v", step.name, limiter.points.rate, step.want)
+		}
+	}
+
+	for i := 0; i < 2*adaptiveSteps; i++ {
+		throttle.adjust()
+	}
+	if throttle.rate != 2100 {
+		t.Errorf("expected the rate to stop at the ceiling, got %v", throttle.rate)
+	}
+}
+
+func TestAdaptiveThrottleCacheSize(t *testing.T) {
+	t.Parallel()
+
+	limiter := newRateLimiter(0, 0, time.Second)
+	throttle, err := newAdaptiveThrottle(limiter, 100, 2100, 1000, time.Second)
+	if err != nil {
+		t.Fatalf("newAdaptiveThrottle() error = %v", err)
+	}
+	size := 5000.0
+	throttle.cacheLimit = 1000
+	throttle.cacheSize = func() (float64, error) { return size, nil }
+
+	if got := throttle.adjust(); got != 500 {
+		t.Errorf("expected a full cache to halve the rate, got %v", got)
+	}
+	size = 10
+	if got := throttle.adjust(); got != 600 {
+		t.Errorf("expected an empty cache to increase the rate, got %v", got)
+	}
+	throttle.cacheSize = func() (float64, error) { return 0, errors.New("unreachable") }
+	if got := throttle.adjust(); got != 700 {
+		t.Errorf("expected an unreadable cache size to be ignored, got %v", got)
+	}
+}
+
+func TestThrottledSender(t *testing.T) {
+	t.Parallel()
+
+	limiter := newRateLimiter(0, 0, time.Second)
+	throttle, err := newAdaptiveThrottle(limiter, 100, 1000, 100, time.Second)
+	if err != nil {
+		t.Fatalf("newAdaptiveThrottle() error = %v", err)
+	}
+	inner := &failingSender{}
+	sender := &throttledSender{Sender: inner, throttle: throttle}
+	if err := sender.SendMetrics([]Metric{NewMetric("foo", "1", 1)}); err == nil {
+		t.Error("expected the error of the wrapped sender")
+	}
+	if inner.attempts != 1 || throttle.writes != 1 || throttle.errors != 1 {
+		t.Errorf("expected one failed write to be observed, got %d attempts, %d writes and %d errors", inner.attempts, throttle.writes, throttle.errors)
+	}
+}
+
+func TestReadCacheSizeWhisper(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	path := filepath.Join(t.TempDir(), "carbon", "agents", "host-a", "cache", "size.wsp")
+	createWhisperFile(t, path, "1m:1d", []*whisper.TimeSeriesPoint{
+		{Time: now - 180, Value: 40},
+		{Time: now - 120, Value: 42},
+	})
+
+	size, err := newCacheSizeReader(path)()
+	if err != nil {
+		t.Fatalf("readCacheSizeWhisper() error = %v", err)
+	}
+	if size != 42 {
+		t.Errorf("expected the latest cache size 42, got %v", size)
+	}
+
+	if _, err := readCacheSizeWhisper(filepath.Join(t.TempDir(), "missing.wsp")); err == nil {
+		t.Error("expected error for a missing whisper file")
+	}
+}
+
+func TestReadCacheSizeRender(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("target") == "missing" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"target": "carbon.agents.a.cache.size", "datapoints": [[10, 1700000000], [20, 1700000060], [null, 1700000120]]},
+			{"target": "carbon.agents.b.cache.size", "datapoints": [[30, 1700000000], [15, 1700000060]]}
+		]`)
+	}))
+	defer server.Close()
+
+	size, err := newCacheSizeReader(server.URL + "/render?target=carbon.agents.*.cache.size&format=json")()
+	if err != nil {
+		t.Fatalf("readCacheSizeRender() error = %v", err)
+	}
+	if size != 20 {
+		t.Errorf("expected the largest latest cache size 20, got %v", size)
+	}
+
+	if _, err := newCacheSizeReader(server.URL + "/render?target=missing&format=json")(); err == nil {
+		t.Error("expected error when no series is returned")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"iter"
+	"math"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// readChunkPoints is the number of points read from an archive at once
+const readChunkPoints = 4096
+
+// Layout of an uncompressed whisper file
+const (
+	whisperHeaderSize      = 16
+	whisperArchiveInfoSize = 12
+	whisperPointSize       = 12
+)
+
+// archiveReader reads the points of one archive of a whisper file straight
+// from the file, readChunkPoints at a time. whisper.Fetch reads a whole time
+// range into memory and picks the archive from its start, so it is only used
+// for compressed files, whose points are read at once.
+type archiveReader struct {
+	whisperData *whisper.Whisper
+	// offset and size locate the ring of points of the archive in the file
+	offset int64
+	size   int
+	step   int
+	// first is the timestamp of the oldest point kept by the archive, end
+	// the one following its newest point
+	first int
+	end   int
+	// fetched holds the points of a compressed file
+	fetched *whisper.TimeSeries
+	// err is the first error met while reading the points
+	err error
+}
+
+// archiveInterval returns the timestamp of the first point of an archive
+// after ts, as whisper.Fetch does
+func archiveInterval(ts int, step int) int {
+	return ts - mod(ts, step) + step
+}
+
+func mod(a int, b int) int {
+	return ((a % b) + b) % b
+}
+
+// fetchedArchive returns the index of the archive whisper.Fetch reads for a
+// range starting at fromTs
+func fetchedArchive(whisperData *whisper.Whisper, fromTs int) int {
+	now := int(whisper.Now().Unix())
+	retentions := whisperData.Retentions()
+	for i, retention := range retentions {
+		if retention.MaxRetention() >= now-max(fromTs, now-whisperData.MaxRetention()) {
+			return i
+		}
+	}
+	return len(retentions) - 1
+}
+
+// newArchiveReader returns the reader of the archive at index, holding the
+// points from fromTs to untilTs as whisper.Fetch would return them. It returns
+// nil when the range is beyond the retention of the file.
+func newArchiveReader(whisperData *whisper.Whisper, index int, fromTs int, untilTs int) (*archiveReader, error) {
+	now := int(whisper.Now().Unix())
+	if fromTs > untilTs {
+		return nil, fmt.Errorf("invalid time interval: from time '%d' is after until time '%d'", fromTs, untilTs)
+	}
+	oldest := now - whisperData.MaxRetention()
+	if fromTs > now || untilTs < oldest {
+		return nil, nil
+	}
+	fromTs, untilTs = max(fromTs, oldest), min(untilTs, now)
+
+	retention := whisperData.Retentions()[index]
+	step := retention.SecondsPerPoint()
+	reader := &archiveReader{whisperData: whisperData, step: step}
+	if whisperData.IsCompressed() {
+		fetched, err := fetchArchive(whisperData, retention, fromTs, untilTs)
+		if err != nil || fetched == nil {
+			return nil, err
+		}
+		reader.fetched = fetched
+		reader.first = fetched.FromTime()
+		reader.end = fetched.FromTime() + len(fetched.Values())*step
+		return reader, nil
+	}
+
+	info := make([]byte, whisperArchiveInfoSize)
+	if _, err := whisperData.File().ReadAt(info, whisperHeaderSize+int64(index)*whisperArchiveInfoSize); err != nil {
+		return nil, err
+	}
+	reader.offset = int64(binary.BigEndian.Uint32(info))
+	reader.size = int(binary.BigEndian.Uint32(info[8:]))
+	reader.first = archiveInterval(fromTs, step)
+	reader.end = archiveInterval(untilTs, step)
+	if reader.first == reader.end {
+		reader.end += step
+	}
+	return reader, nil
+}
+
+// fetchArchive returns the points from fromTs to untilTs of the archive
+// described by retention. whisper.Fetch picks the archive from the distance
+// between its own clock and fromTs, so the request is retried if the clock
+// ticks in between and a coarser archive gets selected.
+func fetchArchive(whisperData *whisper.Whisper, retention whisper.Retention, fromTs int, untilTs int) (*whisper.TimeSeries, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		timeSeries, err := whisperData.Fetch(fromTs, untilTs)
+		if err != nil {
+			return nil, err
+		}
+		if timeSeries == nil || timeSeries.Step() == retention.SecondsPerPoint() {
+			return timeSeries, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to fetch archive %s", retention.String())
+}
+
+// points iterates over the timestamps and values of the archive between
+// fromTs and untilTs, oldest first. Missing points have a NaN value.
+func (reader *archiveReader) points(fromTs int, untilTs int) iter.Seq2[int, float64] {
+	return func(yield func(int, float64) bool) {
+		ts := reader.first
+		if fromTs > ts {
+			ts += (fromTs - ts + reader.step - 1) / reader.step * reader.step
+		}
+		if reader.fetched != nil {
+			reader.fetchedPoints(ts, untilTs, yield)
+			return
+		}
+		reader.err = reader.filePoints(ts, untilTs, yield)
+	}
+}
+
+// fetchedPoints yields the points of a compressed file from ts to untilTs
+func (reader *archiveReader) fetchedPoints(ts int, untilTs int, yield func(int, float64) bool) {
+	values := reader.fetched.Values()
+	for i := (ts - reader.first) / reader.step; i < len(values) && ts <= untilTs; i++ {
+		if !yield(ts, values[i]) {
+			return
+		}
+		ts += reader.step
+	}
+}
+
+// filePoints yields the points of the archive from ts to untilTs, read from
+// the file one chunk at a time
+func (reader *archiveReader) filePoints(ts int, untilTs int, yield func(int, float64) bool) error {
+	base, err := reader.baseInterval()
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, readChunkPoints*whisperPointSize)
+	for ts < reader.end && ts <= untilTs {
+		count := min(readChunkPoints, reader.size, (reader.end-ts)/reader.step)
+		if err := reader.read(buffer[:count*whisperPointSize], base, ts); err != nil {
+			return err
+		}
+		for i := 0; i < count && ts <= untilTs; i++ {
+			value := math.NaN()
+			point := buffer[i*whisperPointSize:]
+			if base != 0 && int(binary.BigEndian.Uint32(point)) == ts {
+				value = math.Float64frombits(binary.BigEndian.Uint64(point[4:]))
+			}
+			if !yield(ts, value) {
+				return nil
+			}
+			ts += reader.step
+		}
+	}
+	return nil
+}
+
+// baseInterval returns the timestamp of the first point of the ring, 0 when
+// the archive was never written
+func (reader *archiveReader) baseInterval() (int, error) {
+	buffer := make([]byte, 4)
+	if _, err := reader.whisperData.File().ReadAt(buffer, reader.offset); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(buffer)), nil
+}
+
+// read fills buffer with the consecutive points of the ring starting at the
+// slot of ts, wrapping around the end of the archive. A ring never written
+// is not read.
+func (reader *archiveReader) read(buffer []byte, base int, ts int) error {
+	if base == 0 {
+		return nil
+	}
+	slot := mod((ts-base)/reader.step, reader.size)
+	head := min(len(buffer), (reader.size-slot)*whisperPointSize)
+	file := reader.whisperData.File()
+	if _, err := file.ReadAt(buffer[:head], reader.offset+int64(slot)*whisperPointSize); err != nil {
+		return err
+	}
+	if head < len(buffer) {
+		if _, err := file.ReadAt(buffer[head:], reader.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
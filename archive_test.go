@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+func TestArchiveReaderMatchesFetch(t *testing.T) {
+	t.Parallel()
+
+	// The 1s archive holds more points than a chunk, the point written
+	// first is the base of the ring and the older ones wrap around it
+	now := int(time.Now().Unix())
+	path := filepath.Join(t.TempDir(), "metric.wsp")
+	points := []*whisper.TimeSeriesPoint{{Time: now - 10, Value: 1}}
+	for ts := now - 7000; ts < now-10; ts += 7 {
+		points = append(points, &whisper.TimeSeriesPoint{Time: ts, Value: float64(ts % 1000)})
+	}
+	createWhisperFile(t, path, "1s:2h,1m:1d", points)
+
+	whisperData, err := whisper.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open whisper file: %v", err)
+	}
+	defer whisperData.Close()
+
+	for _, fromTs := range []int{0, now - 7100, now - 3000, now - 11, now - 3*3600} {
+		checkReaderMatchesFetch(t, whisperData, fromTs, now)
+	}
+}
+
+// checkReaderMatchesFetch fails the test unless the points read from fromTs
+// to now are the ones whisper.Fetch returns
+func checkReaderMatchesFetch(t *testing.T, whisperData *whisper.Whisper, fromTs int, now int) {
+	t.Helper()
+
+	read := readValues(t, whisperData, fromTs, now)
+	fetched, err := whisperData.Fetch(fromTs, now)
+	if err != nil {
+		t.Fatalf("Fetch(%d) error = %v", fromTs, err)
+	}
+	// The clock may tick between the two reads
+	common, known := 0, 0
+	for i, value := range fetched.Values() {
+		ts := fetched.FromTime() + i*fetched.Step()
+		got, ok := read[ts]
+		if !ok {
+			continue
+		}
+		common++
+		if !math.IsNaN(value) {
+			known++
+		}
+		if !sameValue(got, value) {
+			t.Errorf("from %d: point %d = %v, Fetch returned %v", fromTs, ts, got, value)
+		}
+	}
+	if common < len(fetched.Values())-2 || known == 0 {
+		t.Errorf("from %d: %d points in common out of %d, %d known", fromTs, common, len(fetched.Values()), known)
+	}
+}
+
+// readValues returns the values of the points read from fromTs to now
+func readValues(t *testing.T, whisperData *whisper.Whisper, fromTs int, now int) map[int]float64 {
+	t.Helper()
+
+	series, err := readSeries(whisperData, fromTs, now, archiveSelection{mode: archivesFetch, index: -1})
+	if err != nil {
+		t.Fatalf("readSeries(%d) error = %v", fromTs, err)
+	}
+	values := make(map[int]float64)
+	for point := range mergeSeries(series) {
+		values[point.time] = point.value
+	}
+	if err := series[0].reader.err; err != nil {
+		t.Fatalf("reading from %d error = %v", fromTs, err)
+	}
+	return values
+}
+
+// sameValue reports whether two point values are equal, NaN included
+func sameValue(a float64, b float64) bool {
+	return a == b || math.IsNaN(a) && math.IsNaN(b)
+}
+
+func TestArchiveReaderError(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	path := filepath.Join(t.TempDir(), "metric.wsp")
+	createWhisperFile(t, path, "1m:1h", []*whisper.TimeSeriesPoint{{Time: now - 60, Value: 1}})
+
+	source, err := openWhisperSource(path, 0, now, archiveSelection{mode: archivesFetch, index: -1})
+	if err != nil {
+		t.Fatalf("openWhisperSource() error = %v", err)
+	}
+	if err := source.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	for range mergeSeries(source.series) {
+		t.Error("expected no point from a closed file")
+	}
+	if source.err() == nil {
+		t.Error("expected the read error of a closed file")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+)
+
+// batchSize bounds a single write by number of points and by approximate
+// size in bytes, whichever is reached first. A zero value disables the limit.
+type batchSize struct {
+	points int
+	bytes  int
+}
+
+// newBatchSize validates the -batchpoints and -batchbytes flags, at least one
+// of them must bound the batches
+func newBatchSize(points int, bytes int) (batchSize, error) {
+	if points < 0 || bytes < 0 {
+		return batchSize{}, errors.New("batch sizes cannot be negative")
+	}
+	if points == 0 && bytes == 0 {
+		return batchSize{}, errors.New("at least one of -batchpoints and -batchbytes must be set")
+	}
+	return batchSize{points: points, bytes: bytes}, nil
+}
+
+// metricLength approximates the size of a metric in the plaintext protocol:
+// name, value, a ten digit timestamp, two spaces and the newline
+func metricLength(metric Metric) int {
+	return len(metric.Name) + len(metric.Value) + 13
+}
+
+// metricBatch accumulates the metrics of one write. The buffer is reused
+// after every reset, so memory stays bounded by the batch size.
+type metricBatch struct {
+	size    batchSize
+	metrics []Metric
+	bytes   int
+}
+
+func newMetricBatch(size batchSize) *metricBatch {
+	capacity := 1024
+	if size.points > 0 {
+		capacity = min(capacity, size.points)
+	}
+	return &metricBatch{
+		size:    size,
+		metrics: make([]Metric, 0, capacity),
+	}
+}
+
+// add appends a metric and reports whether the batch is full
+func (batch *metricBatch) add(metric Metric) bool {
+	batch.metrics = append(batch.metrics, metric)
+	batch.bytes += metricLength(metric)
+	return (batch.size.points > 0 && len(batch.metrics) >= batch.size.points) ||
+		(batch.size.bytes > 0 && batch.bytes >= batch.size.bytes)
+}
+
+// Len returns the number of metrics in the batch
+func (batch *metricBatch) Len() int {
+	return len(batch.metrics)
+}
+
+// reset empties the batch, keeping its buffer
+func (batch *metricBatch) reset() {
+	clear(batch.metrics)
+	batch.metrics = batch.metrics[:0]
+	batch.bytes = 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewBatchSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		points  int
+		bytes   int
+		wantErr bool
+	}{
+		{10000, 1 << 20, false},
+		{100, 0, false},
+		{0, 4096, false},
+		{0, 0, true},
+		{-1, 4096, true},
+		{100, -1, true},
+	}
+
+	for _, tt := range tests {
+		_, err := newBatchSize(tt.points, tt.bytes)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newBatchSize(%d, %d) error = %v, wantErr %v", tt.points, tt.bytes, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMetricBatch(t *testing.T) {
+	t.Parallel()
+
+	metric := NewMetric("foo.bar", "1.5", 1700000000)
+	tests := []struct {
+		name string
+		size batchSize
+		want int
+	}{
+		{"points", batchSize{points: 3}, 3},
+		{"bytes", batchSize{bytes: 2 * metricLength(metric)}, 2},
+		{"points first", batchSize{points: 2, bytes: 1 << 20}, 2},
+		{"bytes first", batchSize{points: 100, bytes: 1}, 1},
+	}
+
+	for _, tt := range tests {
+		batch := newMetricBatch(tt.size)
+		for round := 0; round < 2; round++ {
+			added := 0
+			for {
+				added++
+				if batch.add(metric) {
+					break
+				}
+			}
+			if added != tt.want || batch.Len() != tt.want {
+				t.Errorf("%s: batch full after %d metrics, want %d", tt.name, added, tt.want)
+			}
+			batch.reset()
+			if batch.Len() != 0 || batch.bytes != 0 {
+				t.Errorf("%s: reset left %d metrics and %d bytes", tt.name, batch.Len(), batch.bytes)
+			}
+		}
+	}
+}
+
+func TestMetricLength(t *testing.T) {
+	t.Parallel()
+
+	metric := NewMetric("foo.bar", "1.5", 1700000000)
+	g := &Graphite{}
+	formatted, ok := g.formatMetric(metric)
+	if !ok {
+		t.Fatal("formatMetric() rejected the metric")
+	}
+	if got := metricLength(metric); got != len(formatted) {
+		t.Errorf("metricLength() = %d, plaintext line is %d bytes", got, len(formatted))
+	}
+}
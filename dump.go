@@ -1,63 +1,40 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"iter"
 	"log"
+	"maps"
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/go-graphite/go-whisper"
 )
 
-type rateLimiter struct {
-	pointsPerSecond int64
-	currentPoints   int64
-	full            chan bool
-	lock            *sync.Mutex
-	enabled         bool
-}
-
-func newRateLimiter(pointsPerSecond int64) *rateLimiter {
-	rl := new(rateLimiter)
-	rl.pointsPerSecond = pointsPerSecond
-	rl.currentPoints = 0
-	rl.full = make(chan bool)
-	rl.lock = new(sync.Mutex)
-	if pointsPerSecond == 0 {
-		rl.enabled = false
-	} else {
-		rl.enabled = true
-		go func() {
-			for {
-				time.Sleep(1 * time.Second)
-				select {
-				case <-rl.full:
-				default:
-				}
-			}
-		}()
-		return rl
-	}
-	return rl
-}
+// taggedDirectory is the top-level directory where carbon stores the whisper
+// files of tagged series
+const taggedDirectory = "_tagged"
 
-func (rl *rateLimiter) limit(n int64) {
-	if !rl.enabled {
-		return
+// decodeTaggedPath recognises the carbon layout of tagged series,
+// _tagged/<hash[0:3]>/<hash[3:6]>/<encoded name>, where the dots of the series
+// name are encoded as _DOT_. It returns the original tagged series name and
+// whether the path follows the layout.
+func decodeTaggedPath(relativePath string) (string, bool, error) {
+	parts := strings.Split(relativePath, "/")
+	if len(parts) != 4 || parts[0] != taggedDirectory || len(parts[1]) != 3 || len(parts[2]) != 3 {
+		return "", false, nil
 	}
-	rl.lock.Lock()
-	defer rl.lock.Unlock()
-
-	rl.currentPoints += n
-	if rl.currentPoints >= rl.pointsPerSecond {
-		rl.full <- true
-		rl.currentPoints = 0
+	if !strings.Contains(parts[3], ";") {
+		return "", true, errors.New("tagged series stored by hash cannot be decoded: " + relativePath)
 	}
+	return strings.ReplaceAll(parts[3], "_DOT_", "."), true, nil
 }
 
 func convertFilename(filename string, baseDirectory string) (string, error) {
@@ -71,23 +48,28 @@ func convertFilename(filename string, baseDirectory string) (string, error) {
 	}
 	err = nil
 	if strings.HasPrefix(absFilename, absBaseDirectory) {
-		metric := strings.ReplaceAll(
-			strings.TrimPrefix(
-				strings.TrimSuffix(
-					strings.TrimPrefix(
-						absFilename,
-						absBaseDirectory),
-					".wsp"),
-				"/"),
-			"/",
-			".")
+		relativePath := strings.TrimPrefix(
+			strings.TrimSuffix(
+				strings.TrimPrefix(
+					absFilename,
+					absBaseDirectory),
+				".wsp"),
+			"/")
+		if metric, tagged, err := decodeTaggedPath(relativePath); tagged {
+			return metric, err
+		}
+		metric := strings.ReplaceAll(relativePath, "/", ".")
 		return metric, err
 	}
 	err = errors.New("path for whisper file does not live in BasePath")
 	return "", err
 }
 
-func sendMetricsWithRetry(graphiteConn *Graphite, metrics []Metric, filename string, connectRetries int) error {
+// errReconnectFailed is returned when a batch fails and the destination cannot
+// be reconnected, the sender is not usable anymore
+var errReconnectFailed = errors.New("failed to reconnect to graphite")
+
+func sendMetricsWithRetry(graphiteConn Sender, metrics []Metric, filename string, connectRetries int) error {
 	var err error
 	for r := 1; r <= connectRetries; r++ {
 		err = graphiteConn.SendMetrics(metrics)
@@ -108,8 +90,7 @@ func sendMetricsWithRetry(graphiteConn *Graphite, metrics []Metric, filename str
 
 		if err := graphiteConn.Connect(); err != nil {
 			log.Printf("Failed to reconnect to graphite: %v", err.Error())
-			time.Sleep(time.Second)
-			break
+			return fmt.Errorf("%w: %v", errReconnectFailed, err)
 		}
 	}
 
@@ -117,95 +98,482 @@ func sendMetricsWithRetry(graphiteConn *Graphite, metrics []Metric, filename str
 	return err
 }
 
+// Archive selection modes accepted by the -archives flag
+const (
+	// archivesFetch reads only the archive picked by whisper.Fetch
+	archivesFetch = "fetch"
+	// archivesMerge reads every archive, preferring the finest one per period
+	archivesMerge = "merge"
+	// archivesSplit reads every archive as a separate, suffixed metric
+	archivesSplit = "split"
+)
+
+// archiveSelection describes which archives of a whisper file are read and,
+// in split mode, how the metric of each archive is named
+type archiveSelection struct {
+	mode string
+	// index restricts split mode to a single archive, -1 selects all of them
+	index int
+	// suffixes holds one name suffix template per archive, the last one is
+	// reused for the remaining archives
+	suffixes []string
+}
+
+// archiveSeries holds the archive read for one metric of a whisper file and
+// the inclusive interval of its points to send
+type archiveSeries struct {
+	suffix  string
+	reader  *archiveReader
+	fromTs  int
+	untilTs int
+}
+
+// points iterates over the timestamps and values of the series, oldest
+// first, reading the archive in chunks
+func (series archiveSeries) points() iter.Seq2[int, float64] {
+	return series.reader.points(series.fromTs, series.untilTs)
+}
+
+// seriesPoint is a point of an archiveSeries, as produced by mergeSeries
+type seriesPoint struct {
+	suffix string
+	time   int
+	value  float64
+}
+
+// mergeSeries iterates over the points of every series in timestamp order.
+// Points sharing a timestamp are produced in the order of the series.
+func mergeSeries(series []archiveSeries) iter.Seq[seriesPoint] {
+	return func(yield func(seriesPoint) bool) {
+		nexts := make([]func() (int, float64, bool), 0, len(series))
+		heads := make([]seriesPoint, 0, len(series))
+		for _, archive := range series {
+			next, stop := iter.Pull2(archive.points())
+			defer stop()
+			if ts, value, ok := next(); ok {
+				nexts = append(nexts, next)
+				heads = append(heads, seriesPoint{suffix: archive.suffix, time: ts, value: value})
+			}
+		}
+
+		for len(heads) > 0 {
+			oldest := 0
+			for i := range heads {
+				if heads[i].time < heads[oldest].time {
+					oldest = i
+				}
+			}
+			if !yield(heads[oldest]) {
+				return
+			}
+			if ts, value, ok := nexts[oldest](); ok {
+				heads[oldest].time = ts
+				heads[oldest].value = value
+			} else {
+				nexts = slices.Delete(nexts, oldest, oldest+1)
+				heads = slices.Delete(heads, oldest, oldest+1)
+			}
+		}
+	}
+}
+
+// newArchiveSelection validates the archive mode and splits the comma
+// separated list of suffix templates
+func newArchiveSelection(mode string, index int, suffixes string) (archiveSelection, error) {
+	if mode != archivesFetch && mode != archivesMerge && mode != archivesSplit {
+		return archiveSelection{}, errors.New("archive mode " + mode + " not supported, use fetch/merge/split")
+	}
+	if index < -1 {
+		return archiveSelection{}, fmt.Errorf("invalid archive index %d", index)
+	}
+	return archiveSelection{
+		mode:     mode,
+		index:    index,
+		suffixes: strings.Split(suffixes, ","),
+	}, nil
+}
+
+// archiveSuffix renders the suffix template of the archive at the given
+// index. The placeholders {index}, {step} and {retention} are replaced with
+// the archive position, precision and retention, e.g. "2", "1h" and "30d".
+func (selection archiveSelection) archiveSuffix(index int, retention whisper.Retention) string {
+	if len(selection.suffixes) == 0 {
+		return ""
+	}
+	template := selection.suffixes[min(index, len(selection.suffixes)-1)]
+	step, period, _ := strings.Cut(retention.String(), ":")
+	return strings.NewReplacer(
+		"{index}", strconv.Itoa(index),
+		"{step}", step,
+		"{retention}", period,
+	).Replace(template)
+}
+
+// readAllArchives walks every archive from the finest to the coarsest and
+// returns one series per archive, the coarsest first, restricted to the
+// points between fromTs and toTs. Each period is taken from the
+// highest-resolution archive that covers it, coarser archives only
+// contribute the points that are older than the finer ones.
+func readAllArchives(whisperData *whisper.Whisper, fromTs int, toTs int) ([]archiveSeries, error) {
+	now := int(whisper.Now().Unix())
+	retentions := whisperData.Retentions()
+	series := make([]archiveSeries, 0, len(retentions))
+	cutoff := math.MaxInt
+	for i, retention := range retentions {
+		reader, err := newArchiveReader(whisperData, i, now-retention.MaxRetention(), now)
+		if err != nil {
+			return nil, err
+		}
+		if reader == nil {
+			continue
+		}
+
+		series = append(series, archiveSeries{
+			reader:  reader,
+			fromTs:  fromTs,
+			untilTs: min(toTs, cutoff-1),
+		})
+		cutoff = min(cutoff, reader.first)
+	}
+	slices.Reverse(series)
+	return series, nil
+}
+
+// readSplitArchives returns the points between fromTs and toTs of every
+// selected archive as a separate series, named after the archive suffix
+func readSplitArchives(whisperData *whisper.Whisper, fromTs int, toTs int, selection archiveSelection) ([]archiveSeries, error) {
+	retentions := whisperData.Retentions()
+	if selection.index >= len(retentions) {
+		return nil, fmt.Errorf("archive index %d out of range, file has %d archives", selection.index, len(retentions))
+	}
+
+	now := int(whisper.Now().Unix())
+	series := make([]archiveSeries, 0, len(retentions))
+	for i, retention := range retentions {
+		if selection.index != -1 && selection.index != i {
+			continue
+		}
+		reader, err := newArchiveReader(whisperData, i, now-retention.MaxRetention(), now)
+		if err != nil {
+			return nil, err
+		}
+		if reader == nil {
+			continue
+		}
+
+		series = append(series, archiveSeries{
+			suffix:  selection.archiveSuffix(i, retention),
+			reader:  reader,
+			fromTs:  fromTs,
+			untilTs: toTs,
+		})
+	}
+	return series, nil
+}
+
+// readSeries returns the series of a whisper file between fromTs and toTs
+// according to the requested archive selection. The points are read from the
+// file while the series are iterated.
+func readSeries(whisperData *whisper.Whisper, fromTs int, toTs int, selection archiveSelection) ([]archiveSeries, error) {
+	switch selection.mode {
+	case archivesSplit:
+		return readSplitArchives(whisperData, fromTs, toTs, selection)
+	case archivesMerge:
+		return readAllArchives(whisperData, fromTs, toTs)
+	}
+
+	reader, err := newArchiveReader(whisperData, fetchedArchive(whisperData, fromTs), fromTs, toTs)
+	if err != nil {
+		return nil, err
+	}
+	if reader == nil {
+		return nil, nil
+	}
+	return []archiveSeries{{reader: reader, fromTs: math.MinInt, untilTs: math.MaxInt}}, nil
+}
+
+// whisperSource is a whisper file opened to read the series of its metric
+type whisperSource struct {
+	whisperData *whisper.Whisper
+	series      []archiveSeries
+}
+
+// openWhisperSource opens a whisper file and selects its series, the file
+// stays open until Close
+func openWhisperSource(filename string, fromTs int, toTs int, selection archiveSelection) (*whisperSource, error) {
+	whisperData, err := whisper.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	series, err := readSeries(whisperData, fromTs, toTs, selection)
+	if err != nil {
+		whisperData.Close()
+		return nil, err
+	}
+	return &whisperSource{whisperData: whisperData, series: series}, nil
+}
+
+// err returns the first error met while reading the series
+func (source *whisperSource) err() error {
+	for _, series := range source.series {
+		if series.reader.err != nil {
+			return series.reader.err
+		}
+	}
+	return nil
+}
+
+// Close closes the whisper file
+func (source *whisperSource) Close() error {
+	return source.whisperData.Close()
+}
+
+// formatValue formats a point value with the fewest digits that parse back
+// to the same float64
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
 func sendWhisperData(
 	filename string,
-	baseDirectory string,
-	graphiteConn *Graphite,
+	roots *sourceRoots,
+	graphiteConn Sender,
 	fromTs int,
 	toTs int,
+	archives archiveSelection,
+	size batchSize,
 	connectRetries int,
 	rateLimiter *rateLimiter,
+	journal *journal,
+	rewriter *metricRewriter,
+	report *fileReport,
 ) error {
-	metricName, err := convertFilename(filename, baseDirectory)
+	metricName, err := convertFilename(filename, roots.base(filename))
 	if err != nil {
 		return err
 	}
+	metricName = rewriter.rewrite(metricName)
+	report.Metric = metricName
 
-	whisperData, err := whisper.Open(filename)
+	metric, err := roots.open(filename, fromTs, toTs, archives)
 	if err != nil {
 		return err
 	}
-	archiveDataPoints, err := whisperData.Fetch(fromTs, toTs)
-	if err != nil {
+	defer metric.Close()
+
+	transfer := &fileTransfer{
+		filename:       filename,
+		metricName:     metricName,
+		sender:         graphiteConn,
+		connectRetries: connectRetries,
+		rateLimiter:    rateLimiter,
+		journal:        journal,
+		report:         report,
+		batch:          newMetricBatch(size),
+		resumes:        make(map[string]*metricResume),
+		pending:        make(map[string]int64),
+	}
+	metric.skipSent(transfer.resumeTs)
+	for point := range metric.points() {
+		if math.IsNaN(point.value) {
+			continue
+		}
+		report.addPoint(int64(point.time))
+		if err := transfer.add(point); err != nil {
+			return err
+		}
+	}
+	if err := metric.err(); err != nil {
+		return err
+	}
+	if err := transfer.flush(); err != nil {
+		return err
+	}
+	return transfer.finish()
+}
+
+// fileTransfer sends the points of a whisper file in batches and records the
+// progress of each of its metrics in the journal.
+//
+// Every metric of the file, one per archive in split mode, is resumed from
+// its own last confirmed timestamp: coarse archives lag behind the finest
+// one. Points at the last confirmed timestamp of a partly sent metric are
+// sent again, as a batch may have ended in the middle of points sharing the
+// same timestamp. A metric sent completely only forwards newer points.
+type fileTransfer struct {
+	filename       string
+	metricName     string
+	sender         Sender
+	connectRetries int
+	rateLimiter    *rateLimiter
+	journal        *journal
+	report         *fileReport
+	batch          *metricBatch
+	resumes        map[string]*metricResume
+	// pending holds the last timestamp of each metric in the batch. The
+	// points are merged in timestamp order, so it is the last confirmed
+	// timestamp of the metric once the batch is sent.
+	pending map[string]int64
+}
+
+// resume returns the journal state of the metric with suffix
+func (transfer *fileTransfer) resume(suffix string) *metricResume {
+	state, ok := transfer.resumes[suffix]
+	if !ok {
+		state = &metricResume{name: appendToName(transfer.metricName, suffix)}
+		state.entry, state.found = transfer.journal.lookup(transfer.filename, suffix)
+		state.lastTs = state.entry.timestamp
+		transfer.resumes[suffix] = state
+	}
+	return state
+}
+
+// resumeTs returns the timestamp of the first point to send of the metric
+// with suffix, without tracking the metric until one of its points is sent
+func (transfer *fileTransfer) resumeTs(suffix string) int64 {
+	if state, ok := transfer.resumes[suffix]; ok {
+		return state.resumeTs()
+	}
+	state := &metricResume{}
+	state.entry, state.found = transfer.journal.lookup(transfer.filename, suffix)
+	return state.resumeTs()
+}
+
+// add adds a point to the batch, sending the batch once it is full or holds
+// the burst of the rate limiter, so that no write exceeds the burst
+func (transfer *fileTransfer) add(point seriesPoint) error {
+	state := transfer.resume(point.suffix)
+	if int64(point.time) < state.resumeTs() {
+		return nil
+	}
+	transfer.pending[point.suffix] = int64(point.time)
+	batch := transfer.batch
+	full := batch.add(NewMetric(state.name, formatValue(point.value), int64(point.time)))
+	if !full && !transfer.rateLimiter.burstReached(int64(batch.Len()), int64(batch.bytes)) {
+		return nil
+	}
+	if err := transfer.send(); err != nil {
+		return err
+	}
+	return transfer.confirm(true)
+}
+
+// flush sends the last batch, whose progress is recorded by finish
+func (transfer *fileTransfer) flush() error {
+	if transfer.batch.Len() == 0 {
+		return nil
+	}
+	if err := transfer.send(); err != nil {
 		return err
 	}
+	return transfer.confirm(false)
+}
 
-	metrics := make([]Metric, 0, 1000)
-	for _, dataPoint := range archiveDataPoints.Points() {
-		interval := dataPoint.Time
-		value := dataPoint.Value
-		if math.IsNaN(value) {
+func (transfer *fileTransfer) send() error {
+	batch := transfer.batch
+	transfer.rateLimiter.limit(int64(batch.Len()), int64(batch.bytes))
+	if err := sendMetricsWithRetry(transfer.sender, batch.metrics, transfer.filename, transfer.connectRetries); err != nil {
+		return err
+	}
+	transfer.report.PointsSent += int64(batch.Len())
+	batch.reset()
+	return nil
+}
+
+// confirm marks the metrics of the batch just sent as sent up to their last
+// point, recording it in the journal when record is set
+func (transfer *fileTransfer) confirm(record bool) error {
+	for suffix, ts := range transfer.pending {
+		state := transfer.resumes[suffix]
+		state.lastTs, state.sent = ts, true
+		if !record {
 			continue
 		}
+		if err := transfer.journal.progress(transfer.filename, suffix, ts); err != nil {
+			return err
+		}
+	}
+	clear(transfer.pending)
+	return nil
+}
 
-		v := strconv.FormatFloat(value, 'f', 20, 64)
-		metrics = append(metrics, NewMetric(metricName, v, int64(interval)))
+// finish records every metric of the file as sent. A file without points is
+// recorded as its metric without suffix. That metric is finished last, as it
+// marks the whole file as sent.
+func (transfer *fileTransfer) finish() error {
+	if len(transfer.resumes) == 0 {
+		transfer.resume("")
 	}
+	suffixes := slices.Sorted(maps.Keys(transfer.resumes))
+	for _, suffix := range slices.Backward(suffixes) {
+		state := transfer.resumes[suffix]
+		if !state.sent && state.found && state.entry.done {
+			continue
+		}
+		if err := transfer.journal.finish(transfer.filename, suffix, state.lastTs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricResume is the journal state of one metric of a whisper file while it
+// is sent
+type metricResume struct {
+	name   string
+	entry  journalEntry
+	found  bool
+	lastTs int64
+	sent   bool
+}
 
-	rateLimiter.limit(int64(len(metrics)))
-	return sendMetricsWithRetry(graphiteConn, metrics, filename, connectRetries)
+// resumeTs returns the timestamp of the first point of the metric to send
+func (state *metricResume) resumeTs() int64 {
+	if !state.found {
+		return 0
+	}
+	if state.entry.done {
+		return state.entry.timestamp + 1
+	}
+	return state.entry.timestamp
 }
 
-func findWhisperFiles(ch chan string, quit chan int, directory string) {
+// fileQueueSize is the number of whisper files the directory scan can queue
+// ahead of the workers
+const fileQueueSize = 1000
+
+// findWhisperFiles sends the path of every whisper file below directory to
+// ch. It stops early, returning the error of ctx, when ctx is done.
+func findWhisperFiles(ctx context.Context, ch chan<- string, directory string) error {
 	visit := func(path string, info os.FileInfo, err error) error {
 		if (info != nil) && !info.IsDir() {
 			if strings.HasSuffix(path, ".wsp") {
-				ch <- path
+				select {
+				case ch <- path:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
 		}
 		return nil
 	}
-	err := filepath.Walk(directory, visit)
-	if err != nil {
-		log.Fatal(err)
-	}
-	close(quit)
+	return filepath.Walk(directory, visit)
 }
 
-func worker(ch chan string,
-	quit chan int,
-	wg *sync.WaitGroup,
-	baseDirectory string,
-	graphiteHost string,
-	graphitePort int,
-	graphiteProtocol string,
-	fromTs int,
-	toTs int,
-	connectRetries int,
-	rateLimiter *rateLimiter) {
-	defer wg.Done()
-
-	graphiteConn, err := GraphiteFactory(graphiteProtocol, graphiteHost, graphitePort, "")
-	if err != nil {
-		log.Printf("Failed to connect to graphite host with error: %v", err.Error())
-		return
-	}
-
+// followWhisperFiles rescans directory in every root each interval until ctx
+// is done, so that the workers keep forwarding the points written since the
+// previous scan
+func followWhisperFiles(ctx context.Context, ch chan<- string, roots *sourceRoots, directory string, interval time.Duration) error {
 	for {
+		start := time.Now()
+		if err := roots.find(ctx, ch, directory); err != nil {
+			return err
+		}
+		log.Printf("Scan of %v completed in %v", directory, time.Since(start))
 		select {
-		case path := <-ch:
-			{
-
-				err := sendWhisperData(path, baseDirectory, graphiteConn, fromTs, toTs, connectRetries, rateLimiter)
-				if err != nil {
-					log.Println(err)
-				} else {
-					log.Println("OK: " + path)
-				}
-			}
-		case <-quit:
-			return
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-
 	}
 }
@@ -1,89 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
 	"testing"
 	"time"
-)
-
-func TestLimitNoTrigger(t *testing.T) {
-	t.Parallel()
-
-	rl := &rateLimiter{
-		pointsPerSecond: 10,
-		currentPoints:   0,
-		full:            make(chan bool, 1), // use buffered channel to avoid blocking
-		lock:            new(sync.Mutex),
-		enabled:         true,
-	}
-
-	rl.limit(5)
-	if rl.currentPoints != 5 {
-		t.Errorf("expected currentPoints to be 5, got %d", rl.currentPoints)
-	}
-	select {
-	case v := <-rl.full:
-		t.Errorf("unexpected event from full channel: %v", v)
-	default:
-	}
-}
-
-func TestLimitTrigger(t *testing.T) {
-	t.Parallel()
-
-	rl := &rateLimiter{
-		pointsPerSecond: 10,
-		currentPoints:   0,
-		full:            make(chan bool, 1), // buffered channel
-		lock:            new(sync.Mutex),
-		enabled:         true,
-	}
-
-	rl.limit(6)
-	if rl.currentPoints != 6 {
-		t.Errorf("expected currentPoints to be 6, got %d", rl.currentPoints)
-	}
-
-	rl.limit(5)
-	if rl.currentPoints != 0 {
-		t.Errorf("expected currentPoints to be reset to 0, got %d", rl.currentPoints)
-	}
-
-	select {
-	case v := <-rl.full:
-		if v != true {
-			t.Errorf("expected true from full channel, got %v", v)
-		}
-	case <-time.After(100 * time.Millisecond):
-		t.Error("expected event in full channel, but none was received")
-	}
-}
 
-func TestLimitWhenDisabled(t *testing.T) {
-	t.Parallel()
-
-	rl := &rateLimiter{
-		pointsPerSecond: 10,
-		currentPoints:   0,
-		full:            make(chan bool, 1),
-		lock:            new(sync.Mutex),
-		enabled:         false,
-	}
-
-	rl.limit(100)
-	if rl.currentPoints != 0 {
-		t.Errorf("expected currentPoints to remain 0 when disabled, got %d", rl.currentPoints)
-	}
-
-	select {
-	case v := <-rl.full:
-		t.Errorf("expected no event in full channel when disabled, but got %v", v)
-	default:
-	}
-}
+	"github.com/go-graphite/go-whisper"
+)
 
 func TestConvertFilename_Valid(t *testing.T) {
 	t.Parallel()
@@ -137,54 +69,6 @@ func TestConvertFilename_AbsError(t *testing.T) {
 	}
 }
 
-func TestNewRateLimiter_Enabled(t *testing.T) {
-	t.Parallel()
-
-	rl := newRateLimiter(100)
-	if rl == nil {
-		t.Fatal("expected non-nil rateLimiter")
-	}
-	if !rl.enabled {
-		t.Error("expected rateLimiter to be enabled")
-	}
-	if rl.pointsPerSecond != 100 {
-		t.Errorf("expected pointsPerSecond to be 100, got %d", rl.pointsPerSecond)
-	}
-	if rl.currentPoints != 0 {
-		t.Errorf("expected currentPoints to be 0, got %d", rl.currentPoints)
-	}
-	if rl.lock == nil {
-		t.Error("expected non-nil lock")
-	}
-	if rl.full == nil {
-		t.Error("expected non-nil full channel")
-	}
-}
-
-func TestNewRateLimiter_Disabled(t *testing.T) {
-	t.Parallel()
-
-	rl := newRateLimiter(0)
-	if rl == nil {
-		t.Fatal("expected non-nil rateLimiter")
-	}
-	if rl.enabled {
-		t.Error("expected rateLimiter to be disabled")
-	}
-	if rl.pointsPerSecond != 0 {
-		t.Errorf("expected pointsPerSecond to be 0, got %d", rl.pointsPerSecond)
-	}
-	if rl.currentPoints != 0 {
-		t.Errorf("expected currentPoints to be 0, got %d", rl.currentPoints)
-	}
-	if rl.lock == nil {
-		t.Error("expected non-nil lock")
-	}
-	if rl.full == nil {
-		t.Error("expected non-nil full channel")
-	}
-}
-
 func createTestFiles(t *testing.T, baseDir string, testFiles []string) {
 	if err := os.MkdirAll(filepath.Join(baseDir, "subdir"), 0755); err != nil {
 		t.Fatalf("failed to create test directory: %v", err)
@@ -201,20 +85,31 @@ func createTestFiles(t *testing.T, baseDir string, testFiles []string) {
 	}
 }
 
-func collectFoundFiles(t *testing.T, ch <-chan string, quit <-chan int) []string {
+func collectFoundFiles(t *testing.T, directory string) []string {
+	t.Helper()
+
+	ch := make(chan string, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- findWhisperFiles(context.Background(), ch, directory)
+		close(ch)
+	}()
+
 	var foundFiles []string
-	done := false
-	for !done {
+	for {
 		select {
-		case file := <-ch:
+		case file, ok := <-ch:
+			if !ok {
+				if err := <-errs; err != nil {
+					t.Fatalf("findWhisperFiles() error = %v", err)
+				}
+				return foundFiles
+			}
 			foundFiles = append(foundFiles, file)
-		case <-quit:
-			done = true
 		case <-time.After(20 * time.Second):
 			t.Fatal("timed out waiting for findWhisperFiles to complete")
 		}
 	}
-	return foundFiles
 }
 
 func TestFindWhisperFiles(t *testing.T) {
@@ -228,12 +123,10 @@ func TestFindWhisperFiles(t *testing.T) {
 
 	createTestFiles(t, baseDir, testFiles)
 
-	ch := make(chan string, 10)
-	quit := make(chan int)
-
-	go findWhisperFiles(ch, quit, baseDir)
-	foundFiles := collectFoundFiles(t, ch, quit)
-
+	foundFiles := collectFoundFiles(t, baseDir)
+	if len(foundFiles) != 3 {
+		t.Errorf("expected 3 whisper files, got %v", foundFiles)
+	}
 	for _, file := range foundFiles {
 		if !strings.HasSuffix(file, ".wsp") {
 			t.Errorf("found file without .wsp extension: %s", file)
@@ -246,24 +139,553 @@ func TestFindWhisperFilesEmptyDirectory(t *testing.T) {
 
 	emptyDir := t.TempDir() + "/" + t.Name()
 
-	ch := make(chan string, 10)
-	quit := make(chan int)
+	if foundFiles := collectFoundFiles(t, emptyDir); len(foundFiles) != 0 {
+		t.Errorf("unexpected files found in empty directory: %v", foundFiles)
+	}
+}
 
-	go findWhisperFiles(ch, quit, emptyDir)
+func TestFindWhisperFilesCanceled(t *testing.T) {
+	t.Parallel()
+
+	baseDir := t.TempDir()
+	createTestFiles(t, baseDir, []string{filepath.Join(baseDir, "test1.wsp")})
 
+	// Nobody reads the channel, as when every worker failed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- findWhisperFiles(ctx, make(chan string), baseDir)
+	}()
 	select {
-	case <-quit:
-	case file := <-ch:
-		t.Errorf("unexpected file found in empty directory: %s", file)
-	case <-time.After(1 * time.Second):
-		t.Fatal("timed out waiting for findWhisperFiles to complete")
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("findWhisperFiles blocked on a canceled context")
 	}
+}
 
-	select {
-	case file, ok := <-ch:
-		if ok {
-			t.Errorf("unexpected file found: %s", file)
+func createWhisperFile(t *testing.T, path string, retentions string, points []*whisper.TimeSeriesPoint) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create directory for %s: %v", path, err)
+	}
+	whisperData, err := whisper.Create(path, whisper.MustParseRetentionDefs(retentions), whisper.Average, 0)
+	if err != nil {
+		t.Fatalf("failed to create whisper file %s: %v", path, err)
+	}
+	defer whisperData.Close()
+
+	for _, point := range points {
+		if err := whisperData.Update(point.Value, point.Time); err != nil {
+			t.Fatalf("failed to update whisper file %s: %v", path, err)
+		}
+	}
+}
+
+// updateWhisperFile writes points to an existing whisper file
+func updateWhisperFile(t *testing.T, path string, points []*whisper.TimeSeriesPoint) {
+	t.Helper()
+
+	whisperData, err := whisper.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open whisper file %s: %v", path, err)
+	}
+	defer whisperData.Close()
+	for _, point := range points {
+		if err := whisperData.Update(point.Value, point.Time); err != nil {
+			t.Fatalf("failed to update whisper file %s: %v", path, err)
+		}
+	}
+}
+
+// openTestWhisperFile opens a whisper file until the end of the test
+func openTestWhisperFile(t *testing.T, path string) *whisper.Whisper {
+	t.Helper()
+
+	whisperData, err := whisper.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open whisper file: %v", err)
+	}
+	t.Cleanup(func() { whisperData.Close() })
+	return whisperData
+}
+
+// readTestSeries reads the series of every archive, in split mode, or of the
+// selected one
+func readTestSeries(t *testing.T, whisperData *whisper.Whisper, index int) []archiveSeries {
+	t.Helper()
+
+	selection, err := newArchiveSelection(archivesSplit, index, ",.{step}")
+	if err != nil {
+		t.Fatalf("newArchiveSelection() error = %v", err)
+	}
+	series, err := readSeries(whisperData, 0, 2147483647, selection)
+	if err != nil {
+		t.Fatalf("readSeries() error = %v", err)
+	}
+	return series
+}
+
+// seriesTimes returns the timestamps of the points of a series
+func seriesTimes(series archiveSeries) []int {
+	var times []int
+	for ts := range series.points() {
+		times = append(times, ts)
+	}
+	return times
+}
+
+// collectSeries returns the known values of the points read in archives mode,
+// checking that they come in timestamp order
+func collectSeries(t *testing.T, whisperData *whisper.Whisper, archives string) map[int]float64 {
+	t.Helper()
+
+	series, err := readSeries(whisperData, 0, 2147483647, archiveSelection{mode: archives, index: -1})
+	if err != nil {
+		t.Fatalf("readSeries(%s) error = %v", archives, err)
+	}
+	if archives == archivesFetch && len(series) != 1 {
+		t.Fatalf("readSeries(%s) expected a single series, got %d", archives, len(series))
+	}
+	values := make(map[int]float64)
+	last := 0
+	for point := range mergeSeries(series) {
+		if point.time < last {
+			t.Errorf("readSeries(%s) returned points out of order: %d after %d", archives, point.time, last)
+		}
+		last = point.time
+		if !math.IsNaN(point.value) {
+			values[point.time] = point.value
+		}
+	}
+	return values
+}
+
+func TestReadSeries(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	recent := now - now%60 - 120
+	old := now - now%3600 - 5*3600
+	path := filepath.Join(t.TempDir(), "metric.wsp")
+	createWhisperFile(t, path, "1m:1h,1h:1d", []*whisper.TimeSeriesPoint{
+		{Time: old, Value: 1},
+		{Time: recent, Value: 2},
+		{Time: recent + 60, Value: 3},
+	})
+	whisperData := openTestWhisperFile(t, path)
+
+	fetched := collectSeries(t, whisperData, archivesFetch)
+	if _, ok := fetched[recent]; ok {
+		t.Errorf("fetch mode should only read the hourly archive, got minute point %d", recent)
+	}
+	if fetched[old] != 1 {
+		t.Errorf("fetch mode expected old point 1, got %v", fetched[old])
+	}
+
+	merged := collectSeries(t, whisperData, archivesMerge)
+	if merged[recent] != 2 || merged[recent+60] != 3 {
+		t.Errorf("merge mode expected minute points 2 and 3, got %v", merged)
+	}
+	if merged[old] != 1 {
+		t.Errorf("merge mode expected old point 1 from the hourly archive, got %v", merged)
+	}
+	for ts, value := range merged {
+		if ts >= now-3600+60 && ts != recent && ts != recent+60 {
+			t.Errorf("merge mode returned rollup %d=%v covered by the minute archive", ts, value)
+		}
+	}
+}
+
+func TestReadSeriesSplit(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	recent := now - now%60 - 120
+	path := filepath.Join(t.TempDir(), "metric.wsp")
+	createWhisperFile(t, path, "1m:1h,1h:1d", []*whisper.TimeSeriesPoint{
+		{Time: recent, Value: 2},
+	})
+	whisperData := openTestWhisperFile(t, path)
+
+	series := readTestSeries(t, whisperData, -1)
+	if len(series) != 2 {
+		t.Fatalf("expected one series per archive, got %d", len(series))
+	}
+	if series[0].suffix != "" || series[1].suffix != ".1h" {
+		t.Errorf("unexpected suffixes %q and %q", series[0].suffix, series[1].suffix)
+	}
+	hourly := seriesTimes(series[1])
+	if step := hourly[1] - hourly[0]; step != 3600 {
+		t.Errorf("expected hourly points in the second series, got step %d", step)
+	}
+
+	series = readTestSeries(t, whisperData, 1)
+	if len(series) != 1 || series[0].suffix != ".1h" {
+		t.Errorf("expected only the hourly series, got %+v", series)
+	}
+
+	selection, err := newArchiveSelection(archivesSplit, 2, ",.{step}")
+	if err != nil {
+		t.Fatalf("newArchiveSelection() error = %v", err)
+	}
+	if _, err := readSeries(whisperData, 0, 2147483647, selection); err == nil {
+		t.Error("expected error for an archive index out of range")
+	}
+}
+
+func TestMergeSeries(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	recent := now - now%3600 - 3600
+	path := filepath.Join(t.TempDir(), "metric.wsp")
+	createWhisperFile(t, path, "1m:1h,1h:1d", []*whisper.TimeSeriesPoint{
+		{Time: recent, Value: 1},
+	})
+	series := readTestSeries(t, openTestWhisperFile(t, path), -1)
+
+	total := 0
+	for _, archive := range series {
+		total += len(seriesTimes(archive))
+	}
+	merged := slices.Collect(mergeSeries(series))
+	if len(merged) != total {
+		t.Fatalf("mergeSeries() returned %d points, want %d", len(merged), total)
+	}
+	for i := 1; i < len(merged); i++ {
+		prev, point := merged[i-1], merged[i]
+		if point.time < prev.time {
+			t.Errorf("point %d at %d after %d", i, point.time, prev.time)
+		}
+		if point.time == prev.time && prev.suffix == ".1h" && point.suffix == "" {
+			t.Errorf("points at %d not in series order", point.time)
+		}
+	}
+
+	for range mergeSeries(series) {
+		break
+	}
+}
+
+func TestArchiveSuffix(t *testing.T) {
+	t.Parallel()
+
+	retention := whisper.NewRetention(3600, 24*30)
+	tests := []struct {
+		suffixes string
+		index    int
+		want     string
+	}{
+		{",.{step}", 0, ""},
+		{",.{step}", 1, ".1h"},
+		{",.{step}", 3, ".1h"},
+		{".a{index}.{step}_{retention}", 2, ".a2.1h_30d"},
+	}
+
+	for _, tt := range tests {
+		selection, err := newArchiveSelection(archivesSplit, -1, tt.suffixes)
+		if err != nil {
+			t.Fatalf("newArchiveSelection() error = %v", err)
+		}
+		if got := selection.archiveSuffix(tt.index, retention); got != tt.want {
+			t.Errorf("archiveSuffix(%q, %d) = %q, want %q", tt.suffixes, tt.index, got, tt.want)
+		}
+	}
+
+	if _, err := newArchiveSelection("bogus", -1, ""); err == nil {
+		t.Error("expected error for an unknown archive mode")
+	}
+}
+
+func TestSendWhisperDataResume(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	first := now - now%60 - 180
+	baseDir := t.TempDir()
+	path := filepath.Join(baseDir, "foo", "bar.wsp")
+	createWhisperFile(t, path, "1m:1h", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 1},
+		{Time: first + 60, Value: 2},
+		{Time: first + 120, Value: 3},
+	})
+
+	j, err := newJournal(filepath.Join(baseDir, "journal"), false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	defer j.Close()
+	if err := j.progress(path, "", int64(first+60)); err != nil {
+		t.Fatalf("progress() error = %v", err)
+	}
+
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	received := make(chan string)
+	go func() {
+		buf := make([]byte, 4096)
+		n, _ := conn2.Read(buf)
+		received <- string(buf[:n])
+	}()
+
+	g := &Graphite{conn: conn1, Protocol: "tcp"}
+	selection := archiveSelection{mode: archivesFetch, index: -1}
+	report := &fileReport{}
+	if err := sendWhisperData(path, testRoots(baseDir), g, 0, 2147483647, selection, batchSize{points: 10000}, 1, newRateLimiter(0, 0, time.Second), j, &metricRewriter{}, report); err != nil {
+		t.Fatalf("sendWhisperData() error = %v", err)
+	}
+	// The points before the last confirmed timestamp are not read again
+	want := fileReport{Metric: "foo.bar", PointsRead: 2, PointsSent: 2, FirstTs: int64(first + 60), LastTs: int64(first + 120)}
+	if *report != want {
+		t.Errorf("unexpected report %+v, want %+v", *report, want)
+	}
+
+	lines := strings.Split(strings.TrimSpace(<-received), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "foo.bar 2 ") || !strings.HasPrefix(lines[1], "foo.bar 3 ") {
+		t.Errorf("expected only the points from the last confirmed timestamp, got %q", lines)
+	}
+	checkJournalEntry(t, j, path, "", journalEntry{done: true, timestamp: int64(first + 120)})
+}
+
+func TestSendWhisperDataBatches(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	first := now - now%60 - 180
+	baseDir := t.TempDir()
+	path := filepath.Join(baseDir, "foo.wsp")
+	createWhisperFile(t, path, "1m:1h", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 1},
+		{Time: first + 60, Value: 2.5},
+		{Time: first + 120, Value: 3},
+	})
+
+	j, err := newJournal(filepath.Join(baseDir, "journal"), false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	defer j.Close()
+
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	received := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(conn2)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	g := &Graphite{conn: conn1, Protocol: "tcp"}
+	selection := archiveSelection{mode: archivesFetch, index: -1}
+	if err := sendWhisperData(path, testRoots(baseDir), g, 0, 2147483647, selection, batchSize{points: 2}, 1, newRateLimiter(0, 0, time.Second), j, &metricRewriter{}, &fileReport{}); err != nil {
+		t.Fatalf("sendWhisperData() error = %v", err)
+	}
+
+	want := []string{
+		fmt.Sprintf("foo 1 %d", first),
+		fmt.Sprintf("foo 2.5 %d", first+60),
+		fmt.Sprintf("foo 3 %d", first+120),
+	}
+	for _, line := range want {
+		select {
+		case got := <-received:
+			if got != line {
+				t.Errorf("expected %q, got %q", line, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", line)
+		}
+	}
+	checkJournalEntry(t, j, path, "", journalEntry{done: true, timestamp: int64(first + 120)})
+}
+
+func TestSendWhisperDataBurst(t *testing.T) {
+	t.Parallel()
+
+	// The batches are cut at the burst of 2 points instead of sending the
+	// 5 points at once and waiting for the debt afterwards
+	now := int(time.Now().Unix())
+	first := now - now%60 - 300
+	baseDir := t.TempDir()
+	path := filepath.Join(baseDir, "foo.wsp")
+	points := make([]*whisper.TimeSeriesPoint, 0, 5)
+	for i := range 5 {
+		points = append(points, &whisper.TimeSeriesPoint{Time: first + i*60, Value: float64(i)})
+	}
+	createWhisperFile(t, path, "1m:1h", points)
+
+	rl, sleeps := fakeClockLimiter(2, 0, time.Second)
+	sender := &recordingSender{}
+	j, _ := newJournal("", false, false)
+	selection := archiveSelection{mode: archivesFetch, index: -1}
+	if err := sendWhisperData(path, testRoots(baseDir), sender, 0, 2147483647, selection, batchSize{points: 10000}, 1, rl, j, &metricRewriter{}, &fileReport{}); err != nil {
+		t.Fatalf("sendWhisperData() error = %v", err)
+	}
+	if !slices.Equal(sender.batches, []int{2, 2, 1}) {
+		t.Errorf("expected batches of at most the burst, got %v", sender.batches)
+	}
+	if want := []time.Duration{time.Second, 500 * time.Millisecond}; !slices.Equal(*sleeps, want) {
+		t.Errorf("expected sleeps %v, got %v", want, *sleeps)
+	}
+}
+
+// expectLines returns the lines received until none arrives for 100ms,
+// failing unless there are the given number of them
+func expectLines(t *testing.T, received <-chan string, lines int) []string {
+	t.Helper()
+
+	got := make([]string, 0, lines)
+	for {
+		select {
+		case line := <-received:
+			got = append(got, line)
+		case <-time.After(100 * time.Millisecond):
+			if len(got) != lines {
+				t.Fatalf("expected %d points, got %q", lines, got)
+			}
+			return got
+		}
+	}
+}
+
+func TestSendWhisperDataFollow(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	first := now - now%60 - 180
+	baseDir := t.TempDir()
+	path := filepath.Join(baseDir, "foo.wsp")
+	createWhisperFile(t, path, "1m:1h", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 1},
+		{Time: first + 60, Value: 2},
+	})
+
+	j, err := newJournal("", false, true)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	received := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(conn2)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	g := &Graphite{conn: conn1, Protocol: "tcp"}
+	selection := archiveSelection{mode: archivesFetch, index: -1}
+	send := func() *fileReport {
+		report := &fileReport{}
+		if err := sendWhisperData(path, testRoots(baseDir), g, 0, 2147483647, selection, batchSize{points: 10000}, 1, newRateLimiter(0, 0, time.Second), j, &metricRewriter{}, report); err != nil {
+			t.Fatalf("sendWhisperData() error = %v", err)
+		}
+		return report
+	}
+
+	send()
+	expectLines(t, received, 2)
+
+	// A rescan only reads the slots after the last point sent
+	if report := send(); report.PointsRead != 0 {
+		t.Errorf("expected no point read again, read %d", report.PointsRead)
+	}
+	expectLines(t, received, 0)
+
+	updateWhisperFile(t, path, []*whisper.TimeSeriesPoint{{Time: first + 120, Value: 3}})
+
+	if report := send(); report.PointsRead != 1 {
+		t.Errorf("expected only the new point to be read, read %d", report.PointsRead)
+	}
+	if line := expectLines(t, received, 1)[0]; !strings.HasPrefix(line, "foo 3 ") {
+		t.Errorf("expected only the new point, got %q", line)
+	}
+}
+
+func TestSendWhisperDataFollowSplit(t *testing.T) {
+	t.Parallel()
+
+	// With an xFilesFactor of 0.5 the 10m point only appears once half of
+	// its 1m points are written, after the 1m archive has moved past it
+	now := int(time.Now().Unix())
+	bucket := now - now%600 - 1200
+	path := filepath.Join(t.TempDir(), "foo.wsp")
+	whisperData, err := whisper.Create(path, whisper.MustParseRetentionDefs("1m:1h,10m:1d"), whisper.Average, 0.5)
+	if err != nil {
+		t.Fatalf("failed to create whisper file: %v", err)
+	}
+	whisperData.Close()
+	updateWhisperFile(t, path, []*whisper.TimeSeriesPoint{
+		{Time: bucket, Value: 1},
+		{Time: bucket + 60, Value: 1},
+		{Time: bucket + 120, Value: 1},
+		{Time: bucket + 180, Value: 1},
+		{Time: bucket + 600, Value: 1},
+	})
+
+	j, err := newJournal("", false, true)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	selection, err := newArchiveSelection(archivesSplit, -1, ",.{step}")
+	if err != nil {
+		t.Fatalf("newArchiveSelection() error = %v", err)
+	}
+	send := func() []Metric {
+		sender := &recordingSender{}
+		if err := sendWhisperData(path, testRoots(filepath.Dir(path)), sender, 0, 2147483647, selection, batchSize{points: 10000}, 1, newRateLimiter(0, 0, time.Second), j, &metricRewriter{}, &fileReport{}); err != nil {
+			t.Fatalf("sendWhisperData() error = %v", err)
+		}
+		return sender.metrics
+	}
+
+	if metrics := send(); len(metrics) != 5 || slices.ContainsFunc(metrics, func(metric Metric) bool { return metric.Name != "foo" }) {
+		t.Fatalf("expected the 5 points of the 1m archive, got %v", metrics)
+	}
+
+	updateWhisperFile(t, path, []*whisper.TimeSeriesPoint{{Time: bucket + 240, Value: 1}})
+
+	metrics := send()
+	if want := []Metric{NewMetric("foo.10m", "1", int64(bucket))}; !slices.Equal(metrics, want) {
+		t.Errorf("expected the new point of the 10m archive, got %v", metrics)
+	}
+	checkJournalEntry(t, j, path, ".10m", journalEntry{done: true, timestamp: int64(bucket)})
+	checkJournalEntry(t, j, path, "", journalEntry{done: true, timestamp: int64(bucket + 600)})
+	if metrics := send(); len(metrics) != 0 {
+		t.Errorf("expected no new point, got %v", metrics)
+	}
+}
+
+func TestConvertFilename_Tagged(t *testing.T) {
+	t.Parallel()
+
+	baseDir := t.TempDir()
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"_tagged/f1a/2b3/cpu_DOT_user;host=web01;dc=eu_DOT_west.wsp", "cpu.user;host=web01;dc=eu.west", false},
+		{"_tagged/f1a/2b3/" + strings.Repeat("ab", 32) + ".wsp", "", true},
+		{"_tagged/abcd/2b3/cpu;host=a.wsp", "_tagged.abcd.2b3.cpu;host=a", false},
+		{"servers/_tagged/f1a/2b3/cpu.wsp", "servers._tagged.f1a.2b3.cpu", false},
+	}
+
+	for _, tt := range tests {
+		metric, err := convertFilename(filepath.Join(baseDir, tt.path), baseDir)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("convertFilename(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+		}
+		if metric != tt.want {
+			t.Errorf("convertFilename(%q) = %q, want %q", tt.path, metric, tt.want)
 		}
-	default:
 	}
 }
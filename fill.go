@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// errNoFillDestination is returned when the metric of a source file has no
+// whisper file in the destination tree
+var errNoFillDestination = errors.New("no destination file")
+
+// fillRange copies the points of src between tstart and tstop into dst, from
+// the finest archive of src that covers each period, as carbonate's fill. It
+// returns the number of points written.
+func fillRange(src *whisper.Whisper, dst *whisper.Whisper, tstart int, tstop int, now int) (int64, error) {
+	var written int64
+	for _, retention := range src.Retentions() {
+		fromTime := max(now-retention.MaxRetention(), tstart)
+		if fromTime >= tstop {
+			continue
+		}
+
+		series, err := src.Fetch(fromTime, tstop)
+		if err != nil {
+			return written, err
+		}
+		if series != nil {
+			points := make([]*whisper.TimeSeriesPoint, 0, len(series.Values()))
+			for i, value := range series.Values() {
+				if !math.IsNaN(value) {
+					points = append(points, &whisper.TimeSeriesPoint{Time: series.FromTime() + i*series.Step(), Value: value})
+				}
+			}
+			if err := dst.UpdateMany(points); err != nil {
+				return written, err
+			}
+			written += int64(len(points))
+		}
+
+		tstop = fromTime
+		if tstop <= tstart {
+			break
+		}
+	}
+	return written, nil
+}
+
+// fillGaps fills the null points of every archive of dst between endAt and
+// startFrom with the points of src, as carbonate's whisper-fill. The archives
+// are walked from the finest to the coarsest, each one only covering the
+// period older than the previous one. The points already in dst are kept.
+func fillGaps(src *whisper.Whisper, dst *whisper.Whisper, startFrom int, endAt int, now int) (int64, error) {
+	var written int64
+	for _, retention := range dst.Retentions() {
+		fromTime := max(endAt, now-retention.MaxRetention())
+		if fromTime >= startFrom {
+			continue
+		}
+
+		series, err := dst.Fetch(fromTime, startFrom)
+		if err != nil {
+			return written, err
+		}
+		if series != nil {
+			filled, err := fillSeries(src, dst, series, now)
+			written += filled
+			if err != nil {
+				return written, err
+			}
+		}
+		startFrom = fromTime
+	}
+	return written, nil
+}
+
+// fillSeries fills the gaps of the points of series, fetched from dst, with
+// the points of src. A gap runs from the first null point to the next point
+// with a value, the bounds are shifted by a second so that the fetch of the
+// source covers exactly the null points.
+func fillSeries(src *whisper.Whisper, dst *whisper.Whisper, series *whisper.TimeSeries, now int) (int64, error) {
+	var written int64
+	gapStart := -1
+	step := series.Step()
+	for i, value := range series.Values() {
+		timestamp := series.FromTime() + i*step
+		if math.IsNaN(value) {
+			if gapStart < 0 {
+				gapStart = timestamp
+			}
+			continue
+		}
+		if gapStart >= 0 {
+			filled, err := fillRange(src, dst, gapStart-1, timestamp-1, now)
+			written += filled
+			if err != nil {
+				return written, err
+			}
+			gapStart = -1
+		}
+	}
+	if gapStart < 0 {
+		return written, nil
+	}
+	filled, err := fillRange(src, dst, gapStart-1, series.UntilTime()-1, now)
+	return written + filled, err
+}
+
+// fillWhisperFile fills the gaps of the whisper file of the same metric in
+// the destination directory with the points of filename, between fromTs and
+// toTs. With several roots the files of the metric in every root are used in
+// turn. The destination file is locked while it is filled, so that carbon can
+// keep writing to it.
+func fillWhisperFile(filename string, roots *sourceRoots, destinationDirectory string, fromTs int, toTs int, journal *journal, report *fileReport) error {
+	metricName, err := convertFilename(filename, roots.base(filename))
+	if err != nil {
+		return err
+	}
+	report.Metric = metricName
+
+	destination := filepath.Join(destinationDirectory, metricPath(metricName))
+	if _, err := os.Stat(destination); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", destination, errNoFillDestination)
+		}
+		return err
+	}
+
+	sources, err := roots.sources(filename)
+	if err != nil {
+		return err
+	}
+	dst, err := whisper.OpenWithOptions(destination, &whisper.Options{FLock: true})
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	now := int(whisper.Now().Unix())
+	for _, source := range sources {
+		written, err := fillFrom(source, dst, min(toTs, now), fromTs, now)
+		report.PointsRead += written
+		report.PointsSent += written
+		if err != nil {
+			return fmt.Errorf("%s: %v", destination, err)
+		}
+	}
+	return journal.finish(filename, "", int64(now))
+}
+
+// fillFrom fills the gaps of dst with the points of the whisper file source
+func fillFrom(source string, dst *whisper.Whisper, startFrom int, endAt int, now int) (int64, error) {
+	src, err := whisper.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	return fillGaps(src, dst, startFrom, endAt, now)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// fetchValues returns the values of the finest archive of a whisper file
+// between from and until
+func fetchValues(t *testing.T, path string, from int, until int) []float64 {
+	t.Helper()
+
+	file, err := whisper.Open(path)
+	if err != nil {
+		t.Fatalf("whisper.Open() error = %v", err)
+	}
+	defer file.Close()
+	series, err := file.Fetch(from, until)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	return series.Values()
+}
+
+func TestFillWhisperFile(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	first := now - now%60 - 600
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	src := filepath.Join(srcDir, "foo", "bar.wsp")
+	dst := filepath.Join(dstDir, "foo", "bar.wsp")
+	createWhisperFile(t, src, "1m:1h,10m:1d", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 1},
+		{Time: first + 60, Value: 2},
+		{Time: first + 120, Value: 3},
+		{Time: first + 180, Value: 4},
+		{Time: first + 240, Value: 5},
+	})
+	createWhisperFile(t, dst, "1m:1h,10m:1d", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 10},
+		{Time: first + 180, Value: 40},
+	})
+
+	j, err := newJournal("", false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	report := &fileReport{}
+	if err := fillWhisperFile(src, testRoots(srcDir), dstDir, 0, 2147483647, j, report); err != nil {
+		t.Fatalf("fillWhisperFile() error = %v", err)
+	}
+	if report.Metric != "foo.bar" || report.PointsSent != 3 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	want := []float64{10, 2, 3, 40, 5}
+	values := fetchValues(t, dst, first-1, first+240)
+	if len(values) != len(want) {
+		t.Fatalf("expected %v, got %v", want, values)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Errorf("expected %v, got %v", want, values)
+			break
+		}
+	}
+}
+
+func TestFillWhisperFileResolutions(t *testing.T) {
+	t.Parallel()
+
+	// The destination keeps a finer archive than the source: its gaps are
+	// filled from the coarser archive of the source, and older periods only
+	// covered by the coarse archives are filled too
+	now := int(time.Now().Unix())
+	recent := now - now%60 - 120
+	old := now - now%600 - 7200
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	src := filepath.Join(srcDir, "foo.wsp")
+	dst := filepath.Join(dstDir, "foo.wsp")
+	createWhisperFile(t, src, "10m:1d", []*whisper.TimeSeriesPoint{
+		{Time: recent - recent%600, Value: 7},
+		{Time: old, Value: 8},
+	})
+	createWhisperFile(t, dst, "1m:1h,10m:1d", nil)
+
+	j, err := newJournal("", false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	if err := fillWhisperFile(src, testRoots(srcDir), dstDir, 0, 2147483647, j, &fileReport{}); err != nil {
+		t.Fatalf("fillWhisperFile() error = %v", err)
+	}
+
+	if values := fetchValues(t, dst, old-1, old); len(values) != 1 || values[0] != 8 {
+		t.Errorf("expected the old point to be filled, got %v", values)
+	}
+	filled := false
+	for _, value := range fetchValues(t, dst, now-3000, now) {
+		if !math.IsNaN(value) {
+			filled = value == 7
+		}
+	}
+	if !filled {
+		t.Error("expected the finest archive to be filled from the coarser source archive")
+	}
+}
+
+func TestFillWhisperFileNoDestination(t *testing.T) {
+	t.Parallel()
+
+	srcDir := t.TempDir()
+	src := filepath.Join(srcDir, "foo.wsp")
+	createWhisperFile(t, src, "1m:1h", nil)
+
+	j, err := newJournal("", false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	err = fillWhisperFile(src, testRoots(srcDir), t.TempDir(), 0, 2147483647, j, &fileReport{})
+	if !errors.Is(err, errNoFillDestination) {
+		t.Errorf("expected errNoFillDestination, got %v", err)
+	}
+}
+
+func TestMigrationRunFill(t *testing.T) {
+	t.Parallel()
+
+	m, baseDir := newTestMigration(t, 2, newNopSender)
+	m.fillDirectory = t.TempDir()
+	now := int(time.Now().Unix())
+	filled := now - 120 - (now-120)%60
+	createWhisperFile(t, filepath.Join(m.fillDirectory, "metric.wsp"), "1m:1h", nil)
+
+	scan := func(ctx context.Context, ch chan<- string) error {
+		return findWhisperFiles(ctx, ch, baseDir)
+	}
+	if err := m.run(context.Background(), 2, make(chan string, 1), scan); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if sent, skipped := m.stats.sent.Load(), m.stats.skipped.Load(); sent != 1 || skipped != 1 {
+		t.Errorf("expected 1 file filled and 1 skipped, got %d and %d", sent, skipped)
+	}
+	if points := m.stats.points.Load(); points != 1 {
+		t.Errorf("expected 1 point filled, got %d", points)
+	}
+	if values := fetchValues(t, filepath.Join(m.fillDirectory, "metric.wsp"), filled-1, filled); len(values) != 1 || values[0] != 1 {
+		t.Errorf("expected the destination to be filled, got %v", values)
+	}
+}
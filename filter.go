@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a filter pattern as a regular expression instead of a
+// Graphite glob
+const regexPrefix = "re:"
+
+// metricFilter selects the metrics to migrate by name. A metric is sent when
+// it matches at least one include pattern, or there are none, and no exclude
+// pattern.
+type metricFilter struct {
+	includes []*regexp.Regexp
+	excludes []*regexp.Regexp
+}
+
+// compileGlob converts a Graphite glob into a regular expression. Wildcards do
+// not cross dots, {a,b} lists alternatives and [...] character classes. The
+// glob also matches every metric below the nodes it matches, so that
+// carbon.agents.* selects the whole carbon.agents.<host> namespaces.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	compiler := &globCompiler{glob: glob}
+	compiler.expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			compiler.expr.WriteString(`[^.]*`)
+		case '?':
+			compiler.expr.WriteString(`[^.]`)
+		case '[':
+			end, err := compiler.class(i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		case '{', '}', ',':
+			if err := compiler.brace(c); err != nil {
+				return nil, err
+			}
+		default:
+			compiler.expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if compiler.inBraces {
+		return nil, errors.New("unbalanced braces in " + glob)
+	}
+	compiler.expr.WriteString(`(?:\..*)?$`)
+	return regexp.Compile(compiler.expr.String())
+}
+
+// globCompiler holds the regular expression of a glob being compiled
+type globCompiler struct {
+	glob     string
+	expr     strings.Builder
+	inBraces bool
+}
+
+// class writes the character class starting at start and returns the index
+// of its closing bracket
+func (compiler *globCompiler) class(start int) (int, error) {
+	end := strings.IndexByte(compiler.glob[start:], ']')
+	if end < 0 {
+		return 0, errors.New("unterminated character class in " + compiler.glob)
+	}
+	class := compiler.glob[start+1 : start+end]
+	if strings.HasPrefix(class, "!") {
+		class = "^" + class[1:]
+	}
+	compiler.expr.WriteString("[" + class + "]")
+	return start + end, nil
+}
+
+// brace writes the alternatives delimiter c, a comma outside braces being a
+// plain character
+func (compiler *globCompiler) brace(c byte) error {
+	switch {
+	case c == '{' && compiler.inBraces:
+		return errors.New("nested braces in " + compiler.glob)
+	case c == '{':
+		compiler.inBraces = true
+		compiler.expr.WriteString("(?:")
+	case c == '}' && !compiler.inBraces:
+		return errors.New("unbalanced braces in " + compiler.glob)
+	case c == '}':
+		compiler.inBraces = false
+		compiler.expr.WriteString(")")
+	case compiler.inBraces:
+		compiler.expr.WriteString("|")
+	default:
+		compiler.expr.WriteString(",")
+	}
+	return nil
+}
+
+// compilePattern compiles a filter pattern, either a Graphite glob or a
+// regular expression prefixed by "re:"
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		return regexp.Compile(expr)
+	}
+	return compileGlob(pattern)
+}
+
+// newMetricFilter compiles the include and exclude patterns
+func newMetricFilter(includes []string, excludes []string) (*metricFilter, error) {
+	filter := new(metricFilter)
+	for _, pattern := range includes {
+		if err := filter.include(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range excludes {
+		if err := filter.exclude(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func (filter *metricFilter) include(pattern string) error {
+	expr, err := compilePattern(pattern)
+	if err != nil {
+		return err
+	}
+	filter.includes = append(filter.includes, expr)
+	return nil
+}
+
+func (filter *metricFilter) exclude(pattern string) error {
+	expr, err := compilePattern(pattern)
+	if err != nil {
+		return err
+	}
+	filter.excludes = append(filter.excludes, expr)
+	return nil
+}
+
+// load reads a filter file, with one "include <pattern>" or
+// "exclude <pattern>" per line. Empty lines and lines starting with # are
+// ignored.
+func (filter *metricFilter) load(path string) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, pattern, _ := strings.Cut(line, " ")
+		pattern = strings.TrimSpace(pattern)
+		switch {
+		case pattern == "":
+			err = errors.New("missing pattern in filter line: " + line)
+		case action == "include":
+			err = filter.include(pattern)
+		case action == "exclude":
+			err = filter.exclude(pattern)
+		default:
+			err = errors.New("unknown filter action: " + line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// match reports whether the metric has to be migrated
+func (filter *metricFilter) match(metricName string) bool {
+	if len(filter.includes) > 0 {
+		included := false
+		for _, expr := range filter.includes {
+			if expr.MatchString(metricName) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, expr := range filter.excludes {
+		if expr.MatchString(metricName) {
+			return false
+		}
+	}
+	return true
+}
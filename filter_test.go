@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompileGlob(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		glob    string
+		name    string
+		matches bool
+	}{
+		{"servers.*.cpu.{user,system}", "servers.web01.cpu.user", true},
+		{"servers.*.cpu.{user,system}", "servers.web01.cpu.system", true},
+		{"servers.*.cpu.{user,system}", "servers.web01.cpu.idle", false},
+		{"servers.*.cpu.{user,system}", "servers.web01.db.cpu.user", false},
+		{"carbon.agents.*", "carbon.agents.host-a.cpuUsage", true},
+		{"carbon.agents.*", "carbon.agentsfoo.host-a", false},
+		{"carbon.agents", "carbon.agents.host-a.cpuUsage", true},
+		{"web0?.load", "web01.load", true},
+		{"web0?.load", "web010.load", false},
+		{"web0[1-3].load", "web02.load", true},
+		{"web0[!1-3].load", "web02.load", false},
+		{"web0[!1-3].load", "web04.load", true},
+		{"a+b.c", "a+b.c", true},
+		{"a+b.c", "aab.c", false},
+	}
+
+	for _, tt := range tests {
+		expr, err := compileGlob(tt.glob)
+		if err != nil {
+			t.Fatalf("compileGlob(%q) error = %v", tt.glob, err)
+		}
+		if got := expr.MatchString(tt.name); got != tt.matches {
+			t.Errorf("glob %q on %q = %v, want %v", tt.glob, tt.name, got, tt.matches)
+		}
+	}
+
+	for _, invalid := range []string{"a.{b,c", "a.b}", "a.{b,{c}}", "a.[bc"} {
+		if _, err := compileGlob(invalid); err == nil {
+			t.Errorf("expected error for glob %q", invalid)
+		}
+	}
+}
+
+func TestMetricFilterMatch(t *testing.T) {
+	t.Parallel()
+
+	filter, err := newMetricFilter(
+		[]string{"servers.*", "re:^collectd\\.web[0-9]+\\."},
+		[]string{"servers.*.cpu.idle", "carbon.agents.*"},
+	)
+	if err != nil {
+		t.Fatalf("newMetricFilter() error = %v", err)
+	}
+
+	tests := map[string]bool{
+		"servers.web01.cpu.user":   true,
+		"servers.web01.cpu.idle":   false,
+		"collectd.web12.load.load": true,
+		"collectd.db01.load.load":  false,
+		"carbon.agents.a.cpuUsage": false,
+		"stats.counters.foo.count": false,
+	}
+	for name, want := range tests {
+		if got := filter.match(name); got != want {
+			t.Errorf("match(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	filter, _ = newMetricFilter(nil, []string{"carbon.agents.*"})
+	if !filter.match("stats.counters.foo.count") || filter.match("carbon.agents.a.cpuUsage") {
+		t.Error("expected an exclude-only filter to send every other metric")
+	}
+
+	if _, err := newMetricFilter([]string{"re:("}, nil); err == nil {
+		t.Error("expected error for an invalid regular expression")
+	}
+}
+
+func TestMetricFilterLoad(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "filters")
+	content := "# migrate only the servers\ninclude servers.*\n\nexclude re:\\.idle$\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write filter file: %v", err)
+	}
+
+	filter := new(metricFilter)
+	if err := filter.load(path); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if !filter.match("servers.web01.cpu.user") || filter.match("servers.web01.cpu.idle") || filter.match("carbon.agents.a") {
+		t.Error("unexpected matches for the loaded filter")
+	}
+
+	for _, invalid := range []string{"keep servers.*\n", "include\n"} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatalf("failed to write filter file: %v", err)
+		}
+		if err := new(metricFilter).load(path); err == nil {
+			t.Errorf("expected error for filter file %q", invalid)
+		}
+	}
+}
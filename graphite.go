@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -16,6 +18,7 @@ type Graphite struct {
 	Protocol   string
 	Timeout    time.Duration
 	Prefix     string
+	TLS        *TLSOptions
 	conn       net.Conn
 	nop        bool
 	DisableLog bool
@@ -47,14 +50,21 @@ func (graphite *Graphite) Connect() error {
 		var err error
 		var conn net.Conn
 
-		if graphite.Protocol == "udp" {
+		if graphite.TLS != nil {
+			return graphite.connectTLS(address)
+		}
+
+		switch graphite.Protocol {
+		case "udp":
 			var udpAddr *net.UDPAddr
 			udpAddr, err = net.ResolveUDPAddr("udp", address)
 			if err != nil {
 				return err
 			}
 			conn, err = net.DialUDP(graphite.Protocol, nil, udpAddr)
-		} else {
+		case "pickle":
+			conn, err = net.DialTimeout("tcp", address, graphite.Timeout)
+		default:
 			conn, err = net.DialTimeout(graphite.Protocol, address, graphite.Timeout)
 		}
 
@@ -68,8 +78,33 @@ func (graphite *Graphite) Connect() error {
 	return nil
 }
 
+// connectTLS populates the Graphite.conn field with a TLS connection, for the
+// protocols running over TCP
+func (graphite *Graphite) connectTLS(address string) error {
+	if graphite.Protocol != "tcp" && graphite.Protocol != "pickle" {
+		return errors.New("TLS is not supported with protocol " + graphite.Protocol)
+	}
+
+	config, err := graphite.TLS.config(graphite.Host)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: graphite.Timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return err
+	}
+
+	graphite.conn = conn
+	return nil
+}
+
 // Given a Graphite struct, Disconnect closes the Graphite.conn field
 func (graphite *Graphite) Disconnect() error {
+	if graphite.conn == nil {
+		return nil
+	}
 	err := graphite.conn.Close()
 	graphite.conn = nil
 	return err
@@ -90,11 +125,12 @@ func (graphite *Graphite) SendMetrics(metrics []Metric) error {
 	return graphite.sendMetrics(metrics)
 }
 
-// formatMetric formats a single metric for sending to Graphite
-func (graphite *Graphite) formatMetric(metric Metric) (string, bool) {
+// resolveMetric returns the prefixed name and the timestamp of a metric, or
+// false for an uninitialized metric
+func (graphite *Graphite) resolveMetric(metric Metric) (string, int64, bool) {
 	zeroed_metric := Metric{} // ignore unintialized metrics
 	if metric == zeroed_metric {
-		return "", false // ignore unintialized metrics
+		return "", 0, false // ignore unintialized metrics
 	}
 
 	timestamp := metric.Timestamp
@@ -107,9 +143,48 @@ func (graphite *Graphite) formatMetric(metric Metric) (string, bool) {
 		metric_name = fmt.Sprintf("%s.%s", graphite.Prefix, metric.Name)
 	}
 
+	return metric_name, timestamp, true
+}
+
+// formatMetric formats a single metric for sending to Graphite
+func (graphite *Graphite) formatMetric(metric Metric) (string, bool) {
+	metric_name, timestamp, valid := graphite.resolveMetric(metric)
+	if !valid {
+		return "", false
+	}
+
 	return fmt.Sprintf("%s %s %d\n", metric_name, metric.Value, timestamp), true
 }
 
+// sendPickle writes the metrics to the connection as length-prefixed pickle
+// messages, each one within the carbon size limit
+func (graphite *Graphite) sendPickle(metrics []Metric) error {
+	batch := newPickleBatch()
+	for _, metric := range metrics {
+		metric_name, timestamp, valid := graphite.resolveMetric(metric)
+		if !valid {
+			continue
+		}
+		if err := batch.add(metric_name, timestamp, metric.Value); err != nil {
+			return err
+		}
+
+		if batch.Len() >= pickleMaxLength-1024 {
+			if _, err := graphite.conn.Write(batch.Bytes()); err != nil {
+				return err
+			}
+			batch = newPickleBatch()
+		}
+	}
+
+	if batch.count > 0 {
+		if _, err := graphite.conn.Write(batch.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // sendMetrics is an internal function that is used to write to the TCP
 // connection in order to communicate metrics to the remote Graphite host
 func (graphite *Graphite) sendMetrics(metrics []Metric) error {
@@ -122,6 +197,10 @@ func (graphite *Graphite) sendMetrics(metrics []Metric) error {
 		return nil
 	}
 
+	if graphite.Protocol == "pickle" {
+		return graphite.sendPickle(metrics)
+	}
+
 	buf := bytes.NewBufferString("")
 	for _, metric := range metrics {
 		formatted, valid := graphite.formatMetric(metric)
@@ -168,6 +247,12 @@ func NewGraphiteWithMetricPrefix(host string, port int, prefix string) (*Graphit
 	return GraphiteFactory("tcp", host, port, prefix)
 }
 
+// NewGraphitePickle is a factory method that's used to create a new Graphite
+// speaking the carbon pickle protocol
+func NewGraphitePickle(host string, port int) (*Graphite, error) {
+	return GraphiteFactory("pickle", host, port, "")
+}
+
 // When a UDP connection to Graphite is required
 func NewGraphiteUDP(host string, port int) (*Graphite, error) {
 	return GraphiteFactory("udp", host, port, "")
@@ -183,13 +268,21 @@ func NewGraphiteNop(host string, port int) *Graphite {
 }
 
 func GraphiteFactory(protocol string, host string, port int, prefix string) (*Graphite, error) {
+	return GraphiteFactoryWithTLS(protocol, host, port, prefix, nil)
+}
+
+// GraphiteFactoryWithTLS creates a new Graphite connected with TLS when
+// tlsOptions is not nil
+func GraphiteFactoryWithTLS(protocol string, host string, port int, prefix string, tlsOptions *TLSOptions) (*Graphite, error) {
 	var graphite *Graphite
 
 	switch protocol {
 	case "tcp":
-		graphite = &Graphite{Host: host, Port: port, Protocol: "tcp", Prefix: prefix}
+		graphite = &Graphite{Host: host, Port: port, Protocol: "tcp", Prefix: prefix, TLS: tlsOptions}
 	case "udp":
-		graphite = &Graphite{Host: host, Port: port, Protocol: "udp", Prefix: prefix}
+		graphite = &Graphite{Host: host, Port: port, Protocol: "udp", Prefix: prefix, TLS: tlsOptions}
+	case "pickle":
+		graphite = &Graphite{Host: host, Port: port, Protocol: "pickle", Prefix: prefix, TLS: tlsOptions}
 	case "nop":
 		graphite = &Graphite{Host: host, Port: port, nop: true}
 	}
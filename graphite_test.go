@@ -294,3 +294,16 @@ func TestSimpleSend(t *testing.T) {
 		}
 	})
 }
+
+func TestFormatMetricTagged(t *testing.T) {
+	t.Parallel()
+
+	g := &Graphite{Prefix: "prefix"}
+	formatted, valid := g.formatMetric(NewMetric("cpu.user;host=web01", "10", 1234567890))
+	if !valid {
+		t.Fatal("expected tagged metric to be valid")
+	}
+	if formatted != "prefix.cpu.user;host=web01 10 1234567890\n" {
+		t.Errorf("formatMetric() = %q", formatted)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxTimeout bounds every write request to InfluxDB
+const influxTimeout = 30 * time.Second
+
+// influxDefaultField is the field of the metrics whose template sets none, as
+// in the InfluxDB graphite input
+const influxDefaultField = "value"
+
+// Escaping of the names of the line protocol
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxMapping turns a dotted metric name into a measurement, a field and
+// tags with the templates of the InfluxDB graphite input: the measurement and
+// field roles name the measurement and the field, any other role is a tag. The
+// tags of a Graphite tagged series are kept.
+type influxMapping struct {
+	templates []*pathTemplate
+}
+
+// influxSeries is a metric name mapped to the InfluxDB data model, the tags
+// being sorted by key
+type influxSeries struct {
+	measurement string
+	field       string
+	tags        [][2]string
+}
+
+// series maps a metric name, the whole path being the measurement when no
+// template matches
+func (mapping *influxMapping) series(name string) influxSeries {
+	path, graphiteTags, _ := strings.Cut(name, ";")
+	series := influxSeries{measurement: path, field: influxDefaultField}
+	tags := make(map[string]string)
+	if template := matchTemplate(mapping.templates, path); template != nil {
+		for role, value := range template.apply(path) {
+			switch role {
+			case "measurement":
+				series.measurement = value
+			case "field":
+				series.field = value
+			default:
+				tags[role] = value
+			}
+		}
+	}
+	for tag := range strings.SplitSeq(graphiteTags, ";") {
+		if key, value, found := strings.Cut(tag, "="); found {
+			tags[key] = value
+		}
+	}
+
+	for key, value := range tags {
+		if key != "" && value != "" {
+			series.tags = append(series.tags, [2]string{key, value})
+		}
+	}
+	slices.SortFunc(series.tags, func(a, b [2]string) int {
+		return strings.Compare(a[0], b[0])
+	})
+	return series
+}
+
+// appendLine appends the line protocol of a metric, with a nanosecond
+// timestamp. Values that are not finite numbers cannot be stored by InfluxDB
+// and are dropped.
+func (mapping *influxMapping) appendLine(buffer *bytes.Buffer, metric Metric) error {
+	value, err := strconv.ParseFloat(metric.Value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %v", metric.Value, metric.Name, err)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return nil
+	}
+
+	series := mapping.series(metric.Name)
+	buffer.WriteString(influxMeasurementEscaper.Replace(series.measurement))
+	for _, tag := range series.tags {
+		buffer.WriteString("," + influxKeyEscaper.Replace(tag[0]) + "=" + influxKeyEscaper.Replace(tag[1]))
+	}
+	buffer.WriteString(" " + influxKeyEscaper.Replace(series.field) + "=" + strconv.FormatFloat(value, 'g', -1, 64))
+	buffer.WriteString(" " + strconv.FormatInt(metric.Timestamp*int64(time.Second), 10) + "\n")
+	return nil
+}
+
+// influxFile is a line protocol file shared by the workers, every batch
+// being written at once
+type influxFile struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// newInfluxFile opens the line protocol file at path. When resume is true the
+// batches are appended to the lines written by the interrupted run, the
+// gzip members of both runs reading as a single stream, otherwise the file is
+// truncated.
+func newInfluxFile(path string, resume bool) (*influxFile, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(filepath.Clean(path), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &influxFile{file: file}, nil
+}
+
+func (output *influxFile) Write(p []byte) (int, error) {
+	output.lock.Lock()
+	defer output.lock.Unlock()
+	return output.file.Write(p)
+}
+
+func (output *influxFile) Close() error {
+	return output.file.Close()
+}
+
+// InfluxWriter is a Sender writing the metrics in the InfluxDB line protocol,
+// every batch in a request to a write endpoint such as /api/v2/write, or to a
+// file. With Gzip the requests, or the batches appended to the file, are
+// compressed.
+type InfluxWriter struct {
+	URL     string
+	Token   string
+	Gzip    bool
+	Mapping *influxMapping
+
+	client *http.Client
+	output io.Writer
+}
+
+// parseInfluxURL validates the URL of an InfluxDB write endpoint, e.g.
+// http://influxdb:8086/api/v2/write?org=acme&bucket=graphite
+func parseInfluxURL(endpoint string) (*url.URL, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.New("invalid InfluxDB URL " + endpoint + ", use http(s)://host:port/api/v2/write?org=...&bucket=...")
+	}
+	return parsed, nil
+}
+
+// NewInfluxHTTPWriter returns an InfluxWriter sending the batches to the
+// write endpoint, verifying https servers with tlsConfig when it is not nil
+func NewInfluxHTTPWriter(endpoint string, token string, compress bool, mapping *influxMapping, tlsConfig *tls.Config) (*InfluxWriter, error) {
+	if _, err := parseInfluxURL(endpoint); err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &InfluxWriter{
+		URL:     endpoint,
+		Token:   token,
+		Gzip:    compress,
+		Mapping: mapping,
+		client:  &http.Client{Timeout: influxTimeout, Transport: transport},
+	}, nil
+}
+
+// NewInfluxFileWriter returns an InfluxWriter appending the batches to output
+func NewInfluxFileWriter(output io.Writer, compress bool, mapping *influxMapping) *InfluxWriter {
+	return &InfluxWriter{Gzip: compress, Mapping: mapping, output: output}
+}
+
+// Connect has nothing to establish, the requests reuse idle connections
+func (writer *InfluxWriter) Connect() error {
+	return nil
+}
+
+// Disconnect closes the idle connections to InfluxDB
+func (writer *InfluxWriter) Disconnect() error {
+	if writer.client != nil {
+		writer.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// SendMetrics writes the metrics as a single request or file write
+func (writer *InfluxWriter) SendMetrics(metrics []Metric) error {
+	var lines bytes.Buffer
+	for _, metric := range metrics {
+		if err := writer.Mapping.appendLine(&lines, metric); err != nil {
+			return err
+		}
+	}
+	if lines.Len() == 0 {
+		return nil
+	}
+
+	body := lines.Bytes()
+	if writer.Gzip {
+		var compressed bytes.Buffer
+		compressor := gzip.NewWriter(&compressed)
+		if _, err := compressor.Write(body); err != nil {
+			return err
+		}
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+	}
+
+	if writer.output != nil {
+		_, err := writer.output.Write(body)
+		return err
+	}
+	return writer.post(body)
+}
+
+// post sends a request body to the write endpoint
+func (writer *InfluxWriter) post(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, writer.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if writer.Gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	if writer.Token != "" {
+		request.Header.Set("Authorization", "Token "+writer.Token)
+	}
+
+	response, err := writer.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("InfluxDB write failed with status %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	_, err = io.Copy(io.Discard, response.Body)
+	return err
+}
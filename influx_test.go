@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestInfluxMapping(t *testing.T, templates ...string) *influxMapping {
+	t.Helper()
+
+	mapping := &influxMapping{}
+	for _, template := range templates {
+		parsed, err := parsePathTemplate(template)
+		if err != nil {
+			t.Fatalf("parsePathTemplate(%q) error = %v", template, err)
+		}
+		mapping.templates = append(mapping.templates, parsed)
+	}
+	return mapping
+}
+
+func TestInfluxMappingLine(t *testing.T) {
+	t.Parallel()
+
+	mapping := newTestInfluxMapping(t,
+		"servers.* .host.measurement.field* dc=eu",
+		"stats.* .measurement*",
+		"app.* .measurement..field",
+	)
+	tests := []struct {
+		metric Metric
+		want   string
+	}{
+		{NewMetric("collectd.web01.load", "0.5", 1700000000), "collectd.web01.load value=0.5 1700000000000000000\n"},
+		{NewMetric("servers.web01.cpu.user.percent", "12", 1700000000), "cpu,dc=eu,host=web01 user.percent=12 1700000000000000000\n"},
+		{NewMetric("servers.web 01.disk,io.read=x", "1e+21", 1700000000), `disk\,io,dc=eu,host=web\ 01 read\=x=1e+21 1700000000000000000` + "\n"},
+		{NewMetric("stats.api.requests", "3", 1700000000), "api.requests value=3 1700000000000000000\n"},
+		{NewMetric("app.checkout.eu.latency", "-2.5", 60), "checkout latency=-2.5 60000000000\n"},
+		{NewMetric("cpu.user;host=web01;dc=us", "1", 60), "cpu.user,dc=us,host=web01 value=1 60000000000\n"},
+		{NewMetric("servers.web01.cpu.idle;dc=us", "1", 60), "cpu,dc=us,host=web01 idle=1 60000000000\n"},
+		{NewMetric("collectd.web01.load", "+Inf", 60), ""},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		if err := mapping.appendLine(&buffer, tt.metric); err != nil {
+			t.Errorf("appendLine(%v) error = %v", tt.metric, err)
+			continue
+		}
+		if got := buffer.String(); got != tt.want {
+			t.Errorf("appendLine(%v) = %q, want %q", tt.metric, got, tt.want)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := mapping.appendLine(&buffer, NewMetric("foo", "bar", 60)); err == nil {
+		t.Error("expected an error for an invalid value")
+	}
+}
+
+// influxWriteHandler accepts the writes to the graphite bucket with the secret
+// token and appends their lines to requests
+func influxWriteHandler(requests *[]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "graphite" || r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = reader
+		}
+		lines, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*requests = append(*requests, string(lines))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestInfluxHTTPWriter(t *testing.T) {
+	t.Parallel()
+
+	var requests []string
+	server := httptest.NewServer(influxWriteHandler(&requests))
+	defer server.Close()
+
+	metrics := []Metric{NewMetric("foo.bar", "1", 60), NewMetric("foo.bar", "2", 120)}
+	for _, compress := range []bool{false, true} {
+		writer, err := NewInfluxHTTPWriter(server.URL+"/api/v2/write?org=acme&bucket=graphite", "secret", compress, &influxMapping{}, nil)
+		if err != nil {
+			t.Fatalf("NewInfluxHTTPWriter() error = %v", err)
+		}
+		if err := writer.SendMetrics(metrics); err != nil {
+			t.Errorf("SendMetrics() with gzip %v error = %v", compress, err)
+		}
+		if err := writer.Disconnect(); err != nil {
+			t.Errorf("Disconnect() error = %v", err)
+		}
+	}
+	want := "foo.bar value=1 60000000000\nfoo.bar value=2 120000000000\n"
+	if !slices.Equal(requests, []string{want, want}) {
+		t.Errorf("unexpected requests %q", requests)
+	}
+}
+
+func TestInfluxHTTPWriterUnauthorized(t *testing.T) {
+	t.Parallel()
+
+	var requests []string
+	server := httptest.NewServer(influxWriteHandler(&requests))
+	defer server.Close()
+
+	writer, err := NewInfluxHTTPWriter(server.URL+"/api/v2/write?org=acme&bucket=graphite", "wrong", false, &influxMapping{}, nil)
+	if err != nil {
+		t.Fatalf("NewInfluxHTTPWriter() error = %v", err)
+	}
+	err = writer.SendMetrics([]Metric{NewMetric("foo.bar", "1", 60)})
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("expected the status and message of a failed write, got %v", err)
+	}
+}
+
+func TestNewInfluxHTTPWriterInvalidURL(t *testing.T) {
+	t.Parallel()
+
+	for _, invalid := range []string{"influxdb:8086/api/v2/write", "ftp://influxdb/api/v2/write", "http:///api/v2/write"} {
+		if _, err := NewInfluxHTTPWriter(invalid, "", false, &influxMapping{}, nil); err == nil {
+			t.Errorf("NewInfluxHTTPWriter(%q) expected an error", invalid)
+		}
+	}
+}
+
+// readGzipFile returns the decompressed content of a file of gzip members
+func readGzipFile(t *testing.T, path string) string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(content)
+}
+
+func TestInfluxFileWriter(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "metrics.lp.gz")
+	output, err := newInfluxFile(path, false)
+	if err != nil {
+		t.Fatalf("newInfluxFile() error = %v", err)
+	}
+	first := NewInfluxFileWriter(output, true, &influxMapping{})
+	second := NewInfluxFileWriter(output, true, &influxMapping{})
+	if err := first.SendMetrics([]Metric{NewMetric("foo", "1", 60)}); err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+	if err := second.SendMetrics([]Metric{NewMetric("bar", "2", 60)}); err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+	if err := second.SendMetrics([]Metric{NewMetric("bar", "NaN", 120)}); err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Every batch is a gzip member, the file reads as a single stream
+	if lines, want := readGzipFile(t, path), "foo value=1 60000000000\nbar value=2 60000000000\n"; lines != want {
+		t.Errorf("expected %q, got %q", want, lines)
+	}
+}
+
+func TestInfluxFileResume(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "metrics.lp.gz")
+	write := func(resume bool, metric Metric) {
+		output, err := newInfluxFile(path, resume)
+		if err != nil {
+			t.Fatalf("newInfluxFile() error = %v", err)
+		}
+		if err := NewInfluxFileWriter(output, true, &influxMapping{}).SendMetrics([]Metric{metric}); err != nil {
+			t.Fatalf("SendMetrics() error = %v", err)
+		}
+		if err := output.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+
+	write(false, NewMetric("foo", "1", 60))
+	write(true, NewMetric("bar", "2", 60))
+	if lines, want := readGzipFile(t, path), "foo value=1 60000000000\nbar value=2 60000000000\n"; lines != want {
+		t.Errorf("expected a resumed run to append to the file, got %q", lines)
+	}
+	write(false, NewMetric("baz", "3", 60))
+	if lines, want := readGzipFile(t, path), "baz value=3 60000000000\n"; lines != want {
+		t.Errorf("expected a new run to truncate the file, got %q", lines)
+	}
+}
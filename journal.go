@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Journal record states
+const (
+	// journalSent marks a file whose points were sent up to a timestamp
+	journalSent = "sent"
+	// journalDone marks a file that has been sent completely
+	journalDone = "done"
+)
+
+// journalEntry is the last known state of a whisper file in the journal
+type journalEntry struct {
+	done      bool
+	timestamp int64
+}
+
+// journalCompactMin is the number of records appended to a journal before it
+// is first compacted
+const journalCompactMin = 1000
+
+// journal is an append-only state file recording the progress of each metric
+// of the whisper files, so that an interrupted migration can be resumed. Every
+// line holds the state, the last confirmed timestamp and the absolute path of
+// the file, separated by tabs, followed by a tab and the name suffix for the
+// archives exported as separate metrics. Later lines override earlier ones for
+// the same metric. Once the appended lines outnumber the metrics, the journal
+// is rewritten with the last state of each one, which bounds its size in
+// follow mode. In follow mode the journal also tracks the state in memory
+// only, when no file is given.
+type journal struct {
+	path    string
+	file    *os.File
+	entries map[string]journalEntry
+	lock    *sync.Mutex
+	enabled bool
+	// records is the number of lines in the journal file
+	records int
+}
+
+// journalKey returns the key of the metric of a whisper file with the name
+// suffix, as written in the journal
+func journalKey(absFilename string, suffix string) string {
+	if suffix == "" {
+		return absFilename
+	}
+	return absFilename + "\t" + suffix
+}
+
+// newJournal opens the journal at path. When resume is true the existing
+// records are loaded and new ones are appended, otherwise the journal is
+// truncated. An empty path returns an in-memory journal when follow is true
+// and a disabled one otherwise.
+func newJournal(path string, resume bool, follow bool) (*journal, error) {
+	j := &journal{
+		entries: make(map[string]journalEntry),
+		lock:    new(sync.Mutex),
+	}
+	if path == "" {
+		if resume {
+			return nil, errors.New("resume requires a journal file")
+		}
+		j.enabled = follow
+		return j, nil
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if resume {
+		if err := j.load(path); err != nil {
+			return nil, err
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(filepath.Clean(path), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.path = filepath.Clean(path)
+	j.file = file
+	j.enabled = true
+	return j, nil
+}
+
+// load reads the records of an existing journal, a missing file is treated as
+// an empty journal and malformed lines, such as one cut short by a crash, are
+// ignored
+func (j *journal) load(path string) error {
+	file, err := os.Open(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 || (fields[0] != journalSent && fields[0] != journalDone) {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		j.entries[fields[2]] = journalEntry{
+			done:      fields[0] == journalDone,
+			timestamp: timestamp,
+		}
+		j.records++
+	}
+	return scanner.Err()
+}
+
+// lookup returns the recorded state of the metric of a whisper file with the
+// name suffix
+func (j *journal) lookup(filename string, suffix string) (journalEntry, bool) {
+	if !j.enabled {
+		return journalEntry{}, false
+	}
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return journalEntry{}, false
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	entry, ok := j.entries[journalKey(absFilename, suffix)]
+	return entry, ok
+}
+
+// progress records that every point of the metric of filename with the name
+// suffix up to timestamp was sent
+func (j *journal) progress(filename string, suffix string, timestamp int64) error {
+	return j.record(filename, suffix, journalEntry{timestamp: timestamp})
+}
+
+// finish records that the metric of filename with the name suffix was sent
+// completely, up to timestamp
+func (j *journal) finish(filename string, suffix string, timestamp int64) error {
+	return j.record(filename, suffix, journalEntry{done: true, timestamp: timestamp})
+}
+
+func (j *journal) record(filename string, suffix string, entry journalEntry) error {
+	if !j.enabled {
+		return nil
+	}
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	key := journalKey(absFilename, suffix)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.entries[key] = entry
+	if j.file == nil {
+		return nil
+	}
+	if j.records >= max(journalCompactMin, 2*len(j.entries)) {
+		return j.compact()
+	}
+	if _, err := io.WriteString(j.file, formatJournalRecord(key, entry)); err != nil {
+		return err
+	}
+	j.records++
+	return nil
+}
+
+// formatJournalRecord returns the journal line of a metric
+func formatJournalRecord(key string, entry journalEntry) string {
+	state := journalSent
+	if entry.done {
+		state = journalDone
+	}
+	return fmt.Sprintf("%s\t%d\t%s\n", state, entry.timestamp, key)
+}
+
+// compact replaces the journal file with one holding a single line per
+// metric. The new file is written aside and renamed over the journal, so
+// that a crash leaves either of them complete.
+func (j *journal) compact() error {
+	temporary := j.path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for key, entry := range j.entries {
+		if _, err := writer.WriteString(formatJournalRecord(key, entry)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(temporary, j.path); err != nil {
+		file.Close()
+		return err
+	}
+	if err := j.file.Close(); err != nil {
+		log.Printf("Failed to close the compacted journal: %v", err)
+	}
+	j.file = file
+	j.records = len(j.entries)
+	return nil
+}
+
+// Close closes the journal file
+func (j *journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkJournalEntry fails the test unless the journal holds want for the
+// metric of filename with suffix
+func checkJournalEntry(t *testing.T, j *journal, filename string, suffix string, want journalEntry) {
+	t.Helper()
+
+	if entry, ok := j.lookup(filename, suffix); !ok || entry != want {
+		t.Errorf("expected %s%s to be recorded as %+v, got %+v (found %v)", filename, suffix, want, entry, ok)
+	}
+}
+
+// fileSize returns the size of the file at path
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %v", path, err)
+	}
+	return info.Size()
+}
+
+func TestJournalDisabled(t *testing.T) {
+	t.Parallel()
+
+	j, err := newJournal("", false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	if j.enabled {
+		t.Error("expected journal without a path to be disabled")
+	}
+	if err := j.finish("metric.wsp", "", 10); err != nil {
+		t.Errorf("finish() on disabled journal error = %v", err)
+	}
+	if _, ok := j.lookup("metric.wsp", ""); ok {
+		t.Error("expected no entries in a disabled journal")
+	}
+	if err := j.Close(); err != nil {
+		t.Errorf("Close() on disabled journal error = %v", err)
+	}
+
+	if _, err := newJournal("", true, false); err == nil {
+		t.Error("expected error when resuming without a journal file")
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := newJournal(path, false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	if err := j.progress("a.wsp", "", 100); err != nil {
+		t.Fatalf("progress() error = %v", err)
+	}
+	if err := j.progress("b.wsp", "", 100); err != nil {
+		t.Fatalf("progress() error = %v", err)
+	}
+	if err := j.finish("b.wsp", "", 200); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// simulate a record cut short by a crash
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	if _, err := file.WriteString("done\t30"); err != nil {
+		t.Fatalf("failed to write journal: %v", err)
+	}
+	file.Close()
+
+	j, err = newJournal(path, true, false)
+	if err != nil {
+		t.Fatalf("newJournal() with resume error = %v", err)
+	}
+	defer j.Close()
+
+	checkJournalEntry(t, j, "a.wsp", "", journalEntry{timestamp: 100})
+	checkJournalEntry(t, j, "b.wsp", "", journalEntry{done: true, timestamp: 200})
+	if _, ok := j.lookup("c.wsp", ""); ok {
+		t.Error("expected no entry for c.wsp")
+	}
+}
+
+func TestJournalTruncate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "journal")
+	if err := os.WriteFile(path, []byte("done\t1\t/tmp/a.wsp\n"), 0600); err != nil {
+		t.Fatalf("failed to write journal: %v", err)
+	}
+
+	j, err := newJournal(path, false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	if _, ok := j.lookup("/tmp/a.wsp", ""); ok {
+		t.Error("expected a fresh journal to ignore existing records")
+	}
+	if err := j.finish("/tmp/b.wsp", "", 5); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+	j.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read journal: %v", err)
+	}
+	if strings.Contains(string(content), "a.wsp") || !strings.Contains(string(content), "done\t5\t/tmp/b.wsp") {
+		t.Errorf("unexpected journal content %q", content)
+	}
+}
+
+func TestJournalInMemory(t *testing.T) {
+	t.Parallel()
+
+	j, err := newJournal("", false, true)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	defer j.Close()
+
+	if err := j.finish("metric.wsp", "", 42); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+	checkJournalEntry(t, j, "metric.wsp", "", journalEntry{done: true, timestamp: 42})
+}
+
+func TestJournalSuffixes(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := newJournal(path, false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	if err := j.finish("metric.wsp", "", 600); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+	if err := j.progress("metric.wsp", ".1h", 0); err != nil {
+		t.Fatalf("progress() error = %v", err)
+	}
+	j.Close()
+
+	j, err = newJournal(path, true, false)
+	if err != nil {
+		t.Fatalf("newJournal() with resume error = %v", err)
+	}
+	defer j.Close()
+	checkJournalEntry(t, j, "metric.wsp", "", journalEntry{done: true, timestamp: 600})
+	checkJournalEntry(t, j, "metric.wsp", ".1h", journalEntry{timestamp: 0})
+	if _, ok := j.lookup("metric.wsp", ".1d"); ok {
+		t.Error("expected no entry for metric.wsp .1d")
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := newJournal(path, false, true)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	// Every scan of follow mode records the same files again. The journal
+	// is only rewritten, and shrinks, once the records outnumber the metrics
+	// again, every other record is appended.
+	replaced := 0
+	var size int64
+	for ts := range int64(3 * journalCompactMin) {
+		if err := j.finish("a.wsp", "", ts); err != nil {
+			t.Fatalf("finish() error = %v", err)
+		}
+		if err := j.finish("b.wsp", ".1h", ts); err != nil {
+			t.Fatalf("finish() error = %v", err)
+		}
+		current := fileSize(t, path)
+		if current <= size {
+			replaced++
+		}
+		size = current
+	}
+	j.Close()
+	if replaced > 6 {
+		t.Errorf("expected the journal to be compacted once every %d records, replaced %d times", journalCompactMin, replaced)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read journal: %v", err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines > journalCompactMin {
+		t.Errorf("expected the journal to be compacted, got %d lines", lines)
+	}
+
+	j, err = newJournal(path, true, true)
+	if err != nil {
+		t.Fatalf("newJournal() with resume error = %v", err)
+	}
+	defer j.Close()
+	want := int64(3*journalCompactMin - 1)
+	checkJournalEntry(t, j, "a.wsp", "", journalEntry{done: true, timestamp: want})
+	checkJournalEntry(t, j, "b.wsp", ".1h", journalEntry{done: true, timestamp: want})
+}
@@ -1,68 +1,863 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/tls"
 	"flag"
+	"io"
 	"log"
-	"sync"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// stringsFlag collects the values of a repeatable flag
+type stringsFlag []string
+
+func (flag *stringsFlag) String() string {
+	return strings.Join(*flag, ",")
+}
+
+func (flag *stringsFlag) Set(value string) error {
+	*flag = append(*flag, value)
+	return nil
+}
+
 func main() {
-	baseDirectory := flag.String(
+	os.Exit(run())
+}
+
+// options holds the command line flags
+type options struct {
+	baseDirectory       string
+	directory           string
+	mergePolicy         string
+	graphiteHost        string
+	graphitePort        int
+	graphiteProtocol    string
+	outputDirectory     string
+	retentions          string
+	aggregation         string
+	xFilesFactor        float64
+	influxURL           string
+	influxFilePath      string
+	influxToken         string
+	influxGzip          bool
+	influxTemplates     stringsFlag
+	influxTemplatesFile string
+	fillDirectory       string
+	storageSchemas      string
+	storageAggregation  string
+	destinations        string
+	hashType            string
+	replicationFactor   int
+	diverseReplicas     bool
+	mirrors             stringsFlag
+	includes            stringsFlag
+	excludes            stringsFlag
+	filterFile          string
+	rewrites            stringsFlag
+	rewriteRules        string
+	tagTemplates        stringsFlag
+	tagTemplatesFile    string
+	prefix              string
+	useTLS              bool
+	tlsCA               string
+	tlsCert             string
+	tlsKey              string
+	tlsServerName       string
+	tlsInsecure         bool
+	workers             int
+	fromTime            string
+	toTime              string
+	archiveMode         string
+	archiveIndex        int
+	archiveSuffix       string
+	batchPoints         int
+	batchBytes          int
+	pointsPerSecond     int64
+	bytesPerSecond      int64
+	burst               time.Duration
+	adaptive            bool
+	adaptiveMin         float64
+	adaptiveMax         float64
+	adaptiveLatency     time.Duration
+	cacheSize           string
+	cacheSizeLimit      float64
+	connectRetries      int
+	journalPath         string
+	resume              bool
+	follow              bool
+	followInterval      time.Duration
+	showProgress        bool
+	progressInterval    time.Duration
+	metricsAddress      string
+	reportPath          string
+	reportFormat        string
+}
+
+// parseOptions parses the command line flags
+func parseOptions() *options {
+	opts := &options{}
+	flag.StringVar(
+		&opts.baseDirectory,
 		"basedirectory",
 		"/var/lib/graphite/whisper",
-		"Base directory where whisper files are located. Used to retrieve the metric name from the filename.")
-	directory := flag.String(
+		"Base directory where whisper files are located. Used to retrieve the metric name from the filename. Comma separated list of base directories, such as the roots of several carbon-cache instances, to merge the files of the same metric")
+	flag.StringVar(
+		&opts.directory,
 		"directory",
 		"/var/lib/graphite/whisper/collectd",
-		"Directory containing the whisper files you want to send to graphite again")
-	graphiteHost := flag.String(
+		"Directory containing the whisper files you want to send to graphite again. With several base directories, the same directory is read below each of them")
+	flag.StringVar(
+		&opts.mergePolicy,
+		"mergepolicy",
+		mergeNonNull,
+		"How the points of a metric found in several base directories are merged (newest: only the most recently modified file, nonnull: the first non-null value in the order of -basedirectory, average: the average of the non-null values)")
+	flag.StringVar(
+		&opts.graphiteHost,
 		"host",
 		"127.0.0.1",
 		"Hostname/IP of the graphite server")
-	graphitePort := flag.Int(
+	flag.IntVar(
+		&opts.graphitePort,
 		"port",
 		2003,
 		"graphite Port")
-	graphiteProtocol := flag.String(
+	flag.StringVar(
+		&opts.graphiteProtocol,
 		"protocol",
 		"tcp",
-		"Protocol to use to transfer graphite data (tcp/udp/nop)")
-	workers := flag.Int(
+		"Protocol to use to transfer graphite data (tcp/udp/pickle/nop), whisper to write the points into new whisper files below -output, or influx to write them in the InfluxDB line protocol to -influxurl or -influxfile")
+	flag.StringVar(
+		&opts.outputDirectory,
+		"output",
+		"",
+		"Directory where the whisper files are written with the whisper protocol")
+	flag.StringVar(
+		&opts.retentions,
+		"retentions",
+		"60s:1d",
+		"Retentions of the whisper files created with the whisper protocol, as in storage-schemas.conf (e.g. 1m:30d,1h:1y)")
+	flag.StringVar(
+		&opts.aggregation,
+		"aggregation",
+		"average",
+		"Aggregation method of the whisper files created with the whisper protocol (average/sum/last/max/min/first)")
+	flag.Float64Var(
+		&opts.xFilesFactor,
+		"xfilesfactor",
+		0.5,
+		"xFilesFactor of the whisper files created with the whisper protocol")
+	flag.StringVar(
+		&opts.influxURL,
+		"influxurl",
+		"",
+		"InfluxDB write endpoint used with the influx protocol, e.g. http://influxdb:8086/api/v2/write?org=acme&bucket=graphite")
+	flag.StringVar(
+		&opts.influxFilePath,
+		"influxfile",
+		"",
+		"File the line protocol is written to with the influx protocol, instead of -influxurl")
+	flag.StringVar(
+		&opts.influxToken,
+		"influxtoken",
+		"",
+		"InfluxDB API token used with -influxurl (default $INFLUX_TOKEN)")
+	flag.BoolVar(
+		&opts.influxGzip,
+		"influxgzip",
+		false,
+		"Compress the requests to -influxurl, or the batches written to -influxfile, with gzip")
+	flag.Var(
+		&opts.influxTemplates,
+		"influxtemplate",
+		"Template '[filter] template [tag=value,...]' mapping path nodes to the InfluxDB measurement, field and tags, e.g. 'servers.* .host.measurement.field*'. Without a matching template the whole name is the measurement and the field is value. Can be repeated")
+	flag.StringVar(
+		&opts.influxTemplatesFile,
+		"influxtemplates",
+		"",
+		"File with one InfluxDB template per line, tried after the -influxtemplate ones")
+	flag.StringVar(
+		&opts.fillDirectory,
+		"fill",
+		"",
+		"Fill the gaps of the whisper files of this destination tree with the points of the files of the same metrics below -directory, like carbonate's whisper-fill, instead of sending them")
+	flag.StringVar(
+		&opts.storageSchemas,
+		"storageschemas",
+		"",
+		"Carbon storage-schemas.conf file picking the retentions of every whisper file created with the whisper protocol, instead of -retentions")
+	flag.StringVar(
+		&opts.storageAggregation,
+		"storageaggregation",
+		"",
+		"Carbon storage-aggregation.conf file picking the aggregation method and xFilesFactor of every whisper file created with the whisper protocol, instead of -aggregation/-xfilesfactor")
+	flag.StringVar(
+		&opts.destinations,
+		"destinations",
+		"",
+		"Comma separated carbon destinations (host:port[:instance]) to route metrics to with carbon consistent hashing, instead of -host/-port")
+	flag.StringVar(
+		&opts.hashType,
+		"hashtype",
+		hashTypeCarbon,
+		"Consistent hashing algorithm used with -destinations (carbon_ch/fnv1a_ch)")
+	flag.IntVar(
+		&opts.replicationFactor,
+		"replication",
+		1,
+		"Number of destinations each metric is sent to with -destinations")
+	flag.BoolVar(
+		&opts.diverseReplicas,
+		"diversereplicas",
+		false,
+		"Send the replicas of a metric to different servers with -destinations")
+	flag.Var(
+		&opts.mirrors,
+		"mirror",
+		"Additional destination every batch is also sent to, as protocol://host:port[?retries=N&tls=true]. Can be repeated")
+	flag.Var(
+		&opts.includes,
+		"include",
+		"Only send the metrics matching this Graphite glob (e.g. servers.*.cpu.{user,system}) or, prefixed by re:, regular expression. Can be repeated")
+	flag.Var(
+		&opts.excludes,
+		"exclude",
+		"Skip the metrics matching this Graphite glob or, prefixed by re:, regular expression. Can be repeated")
+	flag.StringVar(
+		&opts.filterFile,
+		"filterfile",
+		"",
+		"File with one 'include <pattern>' or 'exclude <pattern>' per line, in addition to -include/-exclude")
+	flag.Var(
+		&opts.rewrites,
+		"rewrite",
+		"Rewrite rule 'regex = replacement' applied to the metric names, in order, with \\1 or \\g<name> group references. Can be repeated")
+	flag.StringVar(
+		&opts.rewriteRules,
+		"rewriterules",
+		"",
+		"Carbon rewrite-rules.conf file whose rules are applied after the -rewrite ones")
+	flag.Var(
+		&opts.tagTemplates,
+		"tagtemplate",
+		"Template '[filter] template [tag=value,...]' turning path nodes into Graphite tags, e.g. 'servers.* .host.name*' sends servers.web01.cpu.user as cpu.user;host=web01. The first matching template is used. Can be repeated")
+	flag.StringVar(
+		&opts.tagTemplatesFile,
+		"tagtemplates",
+		"",
+		"File with one tag template per line, tried after the -tagtemplate ones")
+	flag.StringVar(
+		&opts.prefix,
+		"prefix",
+		"",
+		"Prefix added to the metric names after the rewrite rules and tag templates")
+	flag.BoolVar(
+		&opts.useTLS,
+		"tls",
+		false,
+		"Connect to the graphite server with TLS (tcp/pickle protocols only)")
+	flag.StringVar(
+		&opts.tlsCA,
+		"tlsca",
+		"",
+		"PEM bundle of the certificate authorities used to verify the graphite server (default system roots)")
+	flag.StringVar(
+		&opts.tlsCert,
+		"tlscert",
+		"",
+		"PEM client certificate for mutual TLS")
+	flag.StringVar(
+		&opts.tlsKey,
+		"tlskey",
+		"",
+		"PEM client key for mutual TLS")
+	flag.StringVar(
+		&opts.tlsServerName,
+		"tlsservername",
+		"",
+		"Server name used for SNI and certificate verification (default the host)")
+	flag.BoolVar(
+		&opts.tlsInsecure,
+		"tlsinsecure",
+		false,
+		"Skip the verification of the graphite server certificate")
+	flag.IntVar(
+		&opts.workers,
 		"workers",
 		5,
 		"Workers to run in parallel")
-	fromTs := flag.Int(
+	flag.StringVar(
+		&opts.fromTime,
 		"from",
-		0,
-		"Starting timestamp to dump data from")
-	toTs := flag.Int(
+		"0",
+		"Starting time to dump data from: unix timestamp, RFC3339, YYYY-MM-DD [HH:MM[:SS]] in local time, now or an offset from now such as -30d or -6h")
+	flag.StringVar(
+		&opts.toTime,
 		"to",
-		2147483647,
-		"Ending timestamp to dump data up to")
-	pointsPerSecond := flag.Int64(
+		"2147483647",
+		"Ending time to dump data up to, in the same formats as -from")
+	flag.StringVar(
+		&opts.archiveMode,
+		"archives",
+		archivesFetch,
+		"Archives to read from each whisper file (fetch: only the archive whisper picks for -from, merge: every archive, highest resolution first, split: every archive as a separate metric)")
+	flag.IntVar(
+		&opts.archiveIndex,
+		"archive",
+		-1,
+		"Index of the only archive to export in split mode (-1 means every archive)")
+	flag.StringVar(
+		&opts.archiveSuffix,
+		"suffix",
+		",.{step}",
+		"Comma separated metric name suffix templates, one per archive, used in split mode. The last one is reused for the remaining archives. Placeholders: {index}, {step}, {retention}")
+	flag.IntVar(
+		&opts.batchPoints,
+		"batchpoints",
+		10000,
+		"Maximum number of points sent with a single write (0 means no limit)")
+	flag.IntVar(
+		&opts.batchBytes,
+		"batchbytes",
+		1<<20,
+		"Maximum approximate size in bytes of a single write (0 means no limit)")
+	flag.Int64Var(
+		&opts.pointsPerSecond,
 		"pps",
 		0,
 		"Number of maximum points per second to send (0 means rate limiter is disabled)")
-	connectRetries := flag.Int(
+	flag.Int64Var(
+		&opts.bytesPerSecond,
+		"bps",
+		0,
+		"Number of maximum bytes per second to send, measured as plaintext protocol lines (0 means no bandwidth limit)")
+	flag.DurationVar(
+		&opts.burst,
+		"burst",
+		time.Second,
+		"Burst allowed above -pps and -bps, as the time worth of points and bytes at the full rate")
+	flag.BoolVar(
+		&opts.adaptive,
+		"adaptive",
+		false,
+		"Tune the points per second from the write latency and errors of the destinations, starting from -pps, between -adaptivemin and -adaptivemax")
+	flag.Float64Var(
+		&opts.adaptiveMin,
+		"adaptivemin",
+		100,
+		"Minimum points per second in adaptive mode")
+	flag.Float64Var(
+		&opts.adaptiveMax,
+		"adaptivemax",
+		100000,
+		"Maximum points per second in adaptive mode")
+	flag.DurationVar(
+		&opts.adaptiveLatency,
+		"adaptivelatency",
+		500*time.Millisecond,
+		"Average write latency above which adaptive mode slows down")
+	flag.StringVar(
+		&opts.cacheSize,
+		"cachesize",
+		"",
+		"In adaptive mode, also slow down when the carbon cache grows above -cachesizelimit. Whisper file of carbon's cache.size metric, or graphite-web render URL returning it as JSON")
+	flag.Float64Var(
+		&opts.cacheSizeLimit,
+		"cachesizelimit",
+		1000000,
+		"Carbon cache size, in points, above which adaptive mode slows down")
+	flag.IntVar(
+		&opts.connectRetries,
 		"retries",
 		3,
-		"How many connection retries worker will make before failure. It is progressive and each next pause will be equal to 'retry * 1s'")
+		"How many connection retries worker will make before failure. It is progressive and each next pause will be equal to 'retry * 1s'. Also the number of attempts a worker makes to connect, with an exponential backoff")
+	flag.StringVar(
+		&opts.journalPath,
+		"journal",
+		"",
+		"State file recording the progress of each whisper file, used to resume an interrupted migration")
+	flag.BoolVar(
+		&opts.resume,
+		"resume",
+		false,
+		"Resume from the journal: skip the files already sent and continue the partly sent ones from their last confirmed point")
+	flag.BoolVar(
+		&opts.follow,
+		"follow",
+		false,
+		"Keep running and rescan the directory every -interval, sending only the points newer than the last ones sent for each metric")
+	flag.DurationVar(
+		&opts.followInterval,
+		"interval",
+		time.Minute,
+		"Pause between two scans of the directory in follow mode")
+	flag.BoolVar(
+		&opts.showProgress,
+		"progress",
+		false,
+		"Report files and points done, throughput, errors and ETA: as a status line refreshed every second on a terminal, logged every -progressinterval otherwise")
+	flag.DurationVar(
+		&opts.progressInterval,
+		"progressinterval",
+		30*time.Second,
+		"Pause between two progress reports when the output is not a terminal")
+	flag.StringVar(
+		&opts.metricsAddress,
+		"metrics",
+		"",
+		"Address to serve Prometheus metrics on /metrics, e.g. :9108 (empty means disabled)")
+	flag.StringVar(
+		&opts.reportPath,
+		"report",
+		"",
+		"Write a report of every file sent or failed, with the run totals, to this file at the end of the run")
+	flag.StringVar(
+		&opts.reportFormat,
+		"reportformat",
+		reportJSON,
+		"Format of the -report file (json/csv)")
 	flag.Parse()
+	return opts
+}
+
+// run migrates the whisper files and returns the exit code of the process,
+// 1 when any file failed
+func run() int {
+	opts := parseOptions()
+	opts.validate()
+	fromTs, toTs := opts.timeRange()
+
+	stats := newRunStats(opts.workers)
+	rl := newRateLimiter(opts.pointsPerSecond, opts.bytesPerSecond, opts.burst)
+	senders := newSenderFactory(opts, stats, rl)
+	defer senders.Close()
+
+	roots, err := newSourceRoots(opts.baseDirectory, opts.mergePolicy)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := roots.scanDirectories(opts.directory); err != nil {
+		log.Fatalln(err)
+	}
+	archives, err := newArchiveSelection(opts.archiveMode, opts.archiveIndex, opts.archiveSuffix)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	size, err := newBatchSize(opts.batchPoints, opts.batchBytes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	journal, err := newJournal(opts.journalPath, opts.resume, opts.follow)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer journal.Close()
+
+	ch := make(chan string, fileQueueSize)
+	if opts.showProgress {
+		defer startProgress(opts, stats, roots)()
+	}
+	report := newReport(opts, stats)
+	if report != nil {
+		defer closeReport(report)
+	}
+	if opts.metricsAddress != "" {
+		serveMetrics(opts.metricsAddress, &metricsHandler{stats: stats, limiter: rl, queue: ch, destinations: senders.destinations()})
+	}
+	m := &migration{
+		roots:           roots,
+		filter:          newFilter(opts),
+		rewriter:        newRewriter(opts),
+		newSender:       senders.newSender,
+		fromTs:          fromTs,
+		toTs:            toTs,
+		archives:        archives,
+		size:            size,
+		sendRetries:     senders.sendRetries,
+		connectAttempts: max(opts.connectRetries, 1),
+		rateLimiter:     rl,
+		journal:         journal,
+		follow:          opts.follow,
+		fillDirectory:   opts.fillDirectory,
+		stats:           stats,
+		report:          report,
+	}
+
+	// An interrupted run stops taking new files and lets the workers finish
+	// the ones they are sending, so that the journal stays consistent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = m.run(ctx, opts.workers, ch, opts.scan(roots))
+	return exitCode(ctx, err, opts, stats)
+}
+
+// exitCode logs how the run ended and returns the exit code of the process
+func exitCode(ctx context.Context, err error, opts *options, stats *runStats) int {
+	switch {
+	case ctx.Err() != nil && opts.follow:
+		log.Println("Stopped following " + opts.directory)
+	case ctx.Err() != nil:
+		log.Println("Interrupted, stopped before every file was processed")
+		return 1
+	case err != nil:
+		log.Printf("Fatal: %v", err)
+		return 1
+	}
+
+	if failed := stats.failed.Load(); failed > 0 {
+		log.Printf("%d files failed", failed)
+		return 1
+	}
+	return 0
+}
+
+// validate exits when flags that do not work together are set
+func (opts *options) validate() {
+	protocols := []string{"tcp", "udp", "pickle", "nop", "whisper", "influx"}
+	if !slices.Contains(protocols, opts.graphiteProtocol) {
+		log.Fatalln("Graphite protocol " + opts.graphiteProtocol + " not supported, use tcp/udp/pickle/nop/whisper/influx.")
+	}
+	if opts.fillDirectory != "" && (opts.follow || opts.destinations != "" || len(opts.mirrors) > 0) {
+		log.Fatalln("Fill mode does not support -follow, -destinations or -mirror.")
+	}
+	if opts.graphiteProtocol != "whisper" && (opts.storageSchemas != "" || opts.storageAggregation != "") {
+		log.Fatalln("Storage schemas are only supported with protocol whisper.")
+	}
+}
+
+// timeRange returns the timestamps of -from and -to
+func (opts *options) timeRange() (int, int) {
+	now := time.Now()
+	fromTs, err := parseTime(opts.fromTime, now)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	toTs, err := parseTime(opts.toTime, now)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if fromTs > toTs {
+		log.Fatalf("Starting time %v is after ending time %v", opts.fromTime, opts.toTime)
+	}
+	return fromTs, toTs
+}
+
+// tlsOptions returns the TLS settings of the destinations, nil without -tls
+func (opts *options) tlsOptions() *TLSOptions {
+	if !opts.useTLS {
+		return nil
+	}
+	if opts.graphiteProtocol != "tcp" && opts.graphiteProtocol != "pickle" && opts.graphiteProtocol != "influx" {
+		log.Fatalln("TLS is not supported with protocol " + opts.graphiteProtocol + ", use tcp/pickle/influx.")
+	}
+	return &TLSOptions{
+		CAFile:             opts.tlsCA,
+		CertFile:           opts.tlsCert,
+		KeyFile:            opts.tlsKey,
+		ServerName:         opts.tlsServerName,
+		InsecureSkipVerify: opts.tlsInsecure,
+	}
+}
+
+// scan returns the function feeding the workers with the whisper files,
+// rescanning the directory every -interval in follow mode
+func (opts *options) scan(roots *sourceRoots) func(ctx context.Context, ch chan<- string) error {
+	if opts.follow {
+		return func(ctx context.Context, ch chan<- string) error {
+			return followWhisperFiles(ctx, ch, roots, opts.directory, opts.followInterval)
+		}
+	}
+	return func(ctx context.Context, ch chan<- string) error {
+		return roots.find(ctx, ch, opts.directory)
+	}
+}
+
+// newFilter returns the filter of -include, -exclude and -filterfile
+func newFilter(opts *options) *metricFilter {
+	filter, err := newMetricFilter(opts.includes, opts.excludes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if opts.filterFile != "" {
+		if err := filter.load(opts.filterFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return filter
+}
+
+// newRewriter returns the rewriter of the rewrite rules, tag templates and
+// prefix
+func newRewriter(opts *options) *metricRewriter {
+	rewriter, err := newMetricRewriter(opts.rewrites, opts.prefix)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if opts.rewriteRules != "" {
+		if err := rewriter.load(opts.rewriteRules); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for _, template := range opts.tagTemplates {
+		if err := rewriter.addTemplate(template); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.tagTemplatesFile != "" {
+		if err := rewriter.loadTemplates(opts.tagTemplatesFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return rewriter
+}
+
+// startProgress starts reporting the progress of the run and returns the
+// function printing the final report
+func startProgress(opts *options, stats *runStats, roots *sourceRoots) func() {
+	progress := newProgressReporter(os.Stderr, stats)
+	log.SetOutput(progress)
+	if !opts.follow {
+		go progress.countFiles(roots, opts.directory)
+	}
+	go progress.run(opts.progressInterval)
+	return progress.finish
+}
+
+// newReport returns the report of -report, nil without it
+func newReport(opts *options, stats *runStats) *runReport {
+	if opts.reportPath == "" {
+		return nil
+	}
+	report, err := newRunReport(opts.reportPath, opts.reportFormat, stats)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return report
+}
+
+// closeReport writes the end of the report
+func closeReport(report *runReport) {
+	if err := report.Close(); err != nil {
+		log.Printf("Failed to write the report: %v", err)
+	}
+}
+
+// senderFactory creates the senders of the workers, wrapping the primary
+// destination with the mirrors, the adaptive throttle and the run statistics
+type senderFactory struct {
+	newSender func() (Sender, error)
+	// sendRetries is the number of attempts the workers make for a batch
+	sendRetries int
+	// name and stats describe the primary destination
+	name  string
+	stats *destinationStats
+	// output is the file written by the influx protocol, if any
+	output  io.Closer
+	mirrors []*mirrorDestination
+}
+
+func newSenderFactory(opts *options, stats *runStats, rl *rateLimiter) *senderFactory {
+	tlsOptions := opts.tlsOptions()
+	senders := &senderFactory{sendRetries: opts.connectRetries, stats: new(destinationStats)}
+	senders.newSender, senders.name, senders.output = newPrimarySender(opts, tlsOptions)
+	if opts.fillDirectory != "" {
+		// The files are filled without a sender
+		senders.newSender = func() (Sender, error) {
+			return NewGraphiteNop("", 0), nil
+		}
+	}
+	if len(opts.mirrors) > 0 {
+		senders.addMirrors(opts, tlsOptions, &stats.reconnects)
+	}
+	if opts.adaptive {
+		senders.addThrottle(opts, rl)
+	}
+	newUninstrumented := senders.newSender
+	senders.newSender = func() (Sender, error) {
+		sender, err := newUninstrumented()
+		if err != nil {
+			return nil, err
+		}
+		return &statsSender{Sender: sender, stats: stats}, nil
+	}
+	return senders
+}
+
+// newPrimarySender returns the factory and the name of the destination of
+// -protocol, with the file it writes to
+func newPrimarySender(opts *options, tlsOptions *TLSOptions) (func() (Sender, error), string, io.Closer) {
+	switch {
+	case opts.graphiteProtocol == "whisper":
+		return newWhisperSender(opts)
+	case opts.graphiteProtocol == "influx":
+		return newInfluxSender(opts, tlsOptions)
+	case opts.destinations != "":
+		carbonDestinations, err := parseDestinations(opts.destinations)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return func() (Sender, error) {
+			return NewCarbonRouter(carbonDestinations, opts.hashType, opts.replicationFactor, opts.diverseReplicas, opts.graphiteProtocol, tlsOptions)
+		}, opts.graphiteProtocol + "://" + opts.destinations, nil
+	}
+	return func() (Sender, error) {
+		return GraphiteFactoryWithTLS(opts.graphiteProtocol, opts.graphiteHost, opts.graphitePort, "", tlsOptions)
+	}, opts.graphiteProtocol + "://" + net.JoinHostPort(opts.graphiteHost, strconv.Itoa(opts.graphitePort)), nil
+}
+
+func newWhisperSender(opts *options) (func() (Sender, error), string, io.Closer) {
+	if opts.destinations != "" {
+		log.Fatalln("Destinations are not supported with protocol whisper, use -output.")
+	}
+	schema, err := newWhisperSchema(opts.retentions, opts.aggregation, opts.xFilesFactor)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if opts.outputDirectory == "" {
+		log.Fatalln("An output directory is required with protocol whisper, use -output.")
+	}
+	rules := newStorageRules(schema)
+	if opts.storageSchemas != "" {
+		if err := rules.loadSchemas(opts.storageSchemas); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.storageAggregation != "" {
+		if err := rules.loadAggregation(opts.storageAggregation); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return func() (Sender, error) {
+		return NewWhisperWriter(opts.outputDirectory, rules.schema)
+	}, "whisper://" + opts.outputDirectory, nil
+}
+
+func newInfluxSender(opts *options, tlsOptions *TLSOptions) (func() (Sender, error), string, io.Closer) {
+	if opts.destinations != "" {
+		log.Fatalln("Destinations are not supported with protocol influx, use -influxurl.")
+	}
+	mapping := newInfluxMapping(opts)
+	switch {
+	case (opts.influxURL == "") == (opts.influxFilePath == ""):
+		log.Fatalln("Either -influxurl or -influxfile is required with protocol influx.")
+	case opts.influxFilePath != "":
+		output, err := newInfluxFile(opts.influxFilePath, opts.resume)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return func() (Sender, error) {
+			return NewInfluxFileWriter(output, opts.influxGzip, mapping), nil
+		}, "file://" + opts.influxFilePath, output
+	}
+
+	endpoint, err := parseInfluxURL(opts.influxURL)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var tlsConfig *tls.Config
+	if tlsOptions != nil {
+		if tlsConfig, err = tlsOptions.config(endpoint.Hostname()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	token := cmp.Or(opts.influxToken, os.Getenv("INFLUX_TOKEN"))
+	return func() (Sender, error) {
+		return NewInfluxHTTPWriter(opts.influxURL, token, opts.influxGzip, mapping, tlsConfig)
+	}, "influx://" + endpoint.Host + endpoint.Path, nil
+}
+
+// newInfluxMapping returns the mapping of the -influxtemplate and
+// -influxtemplates templates
+func newInfluxMapping(opts *options) *influxMapping {
+	mapping := &influxMapping{}
+	for _, template := range opts.influxTemplates {
+		parsed, err := parsePathTemplate(template)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mapping.templates = append(mapping.templates, parsed)
+	}
+	if opts.influxTemplatesFile != "" {
+		templates, err := loadPathTemplates(opts.influxTemplatesFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mapping.templates = append(mapping.templates, templates...)
+	}
+	return mapping
+}
+
+// addMirrors sends every batch to the -mirror destinations too. With mirrors
+// every destination retries on its own, so the batches are only attempted
+// once by the workers.
+func (senders *senderFactory) addMirrors(opts *options, tlsOptions *TLSOptions, reconnects *atomic.Int64) {
+	for _, mirror := range opts.mirrors {
+		destination, err := parseMirrorDestination(mirror, opts.connectRetries)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		senders.mirrors = append(senders.mirrors, destination)
+	}
+	newPrimary := senders.newSender
+	senders.newSender = func() (Sender, error) {
+		primary, err := newPrimary()
+		if err != nil {
+			return nil, err
+		}
+		return NewMirror(primary, senders.name, opts.connectRetries, senders.stats, senders.mirrors, tlsOptions, reconnects)
+	}
+	senders.sendRetries = 1
+}
+
+// addThrottle tunes the rate limiter from the writes of the senders
+func (senders *senderFactory) addThrottle(opts *options, rl *rateLimiter) {
+	throttle, err := newAdaptiveThrottle(rl, opts.adaptiveMin, opts.adaptiveMax, float64(opts.pointsPerSecond), opts.adaptiveLatency)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if opts.cacheSize != "" {
+		throttle.cacheSize = newCacheSizeReader(opts.cacheSize)
+		throttle.cacheLimit = opts.cacheSizeLimit
+	}
+	newUnthrottled := senders.newSender
+	senders.newSender = func() (Sender, error) {
+		sender, err := newUnthrottled()
+		if err != nil {
+			return nil, err
+		}
+		return &throttledSender{Sender: sender, throttle: throttle}, nil
+	}
+	go throttle.run(time.Second)
+}
 
-	if *graphiteProtocol != "tcp" &&
-		*graphiteProtocol != "udp" &&
-		*graphiteProtocol != "nop" {
-		log.Fatalln("Graphite protocol " + *graphiteProtocol + " not supported, use tcp/udp/nop.")
+// destinations returns the statistics of every destination, exported with
+// mirrors only
+func (senders *senderFactory) destinations() []namedStats {
+	if len(senders.mirrors) == 0 {
+		return nil
 	}
-	ch := make(chan string)
-	quit := make(chan int)
-	var wg sync.WaitGroup
+	destinations := []namedStats{{name: senders.name, stats: senders.stats}}
+	for _, destination := range senders.mirrors {
+		destinations = append(destinations, namedStats{name: destination.name, stats: destination.stats})
+	}
+	return destinations
+}
 
-	rl := newRateLimiter(*pointsPerSecond)
-	wg.Add(*workers)
-	for i := 0; i < *workers; i++ {
-		go worker(ch, quit, &wg, *baseDirectory, *graphiteHost, *graphitePort, *graphiteProtocol, *fromTs, *toTs, *connectRetries, rl)
+// Close logs the statistics of the destinations and closes the output file
+func (senders *senderFactory) Close() {
+	if len(senders.mirrors) > 0 {
+		logDestinationStats(senders.name, senders.stats, senders.mirrors)
+	}
+	if senders.output != nil {
+		senders.output.Close()
 	}
-	go findWhisperFiles(ch, quit, *directory)
-	wg.Wait()
 }
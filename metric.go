@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -28,3 +29,13 @@ func (metric Metric) String() string {
 		time.Unix(metric.Timestamp, 0).UTC().Format("2006-01-02 15:04:05"),
 	)
 }
+
+// appendToName appends suffix to the series name of a metric, before the tags
+// of a Graphite tagged name such as cpu.user;host=web01
+func appendToName(name string, suffix string) string {
+	series, tags, tagged := strings.Cut(name, ";")
+	if !tagged {
+		return name + suffix
+	}
+	return series + suffix + ";" + tags
+}
@@ -67,3 +67,16 @@ func TestNewMetric(t *testing.T) {
 		t.Errorf("Expected Timestamp to be %d, got %d", timestamp, metric.Timestamp)
 	}
 }
+
+func TestAppendToName(t *testing.T) {
+	tests := map[string]string{
+		"foo.bar":               "foo.bar.1h",
+		"cpu.user;host=web01":   "cpu.user.1h;host=web01",
+		"cpu.user;host=a;dc=eu": "cpu.user.1h;host=a;dc=eu",
+	}
+	for name, want := range tests {
+		if got := appendToName(name, ".1h"); got != want {
+			t.Errorf("appendToName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+// mirrorDestination describes one of the destinations every batch is
+// mirrored to, with its own protocol and retry policy
+type mirrorDestination struct {
+	name     string
+	protocol string
+	host     string
+	port     int
+	retries  int
+	tls      bool
+	stats    *destinationStats
+}
+
+// destinationStats counts the batches and points sent to a destination, it is
+// shared by the workers
+type destinationStats struct {
+	sentBatches   atomic.Int64
+	sentPoints    atomic.Int64
+	failedBatches atomic.Int64
+	failedPoints  atomic.Int64
+}
+
+func (stats *destinationStats) String() string {
+	return fmt.Sprintf(
+		"%d batches (%d points) sent, %d batches (%d points) failed",
+		stats.sentBatches.Load(),
+		stats.sentPoints.Load(),
+		stats.failedBatches.Load(),
+		stats.failedPoints.Load(),
+	)
+}
+
+// parseMirrorDestination parses a destination in the
+// protocol://host:port[?retries=N&tls=true] form
+func parseMirrorDestination(destination string, defaultRetries int) (*mirrorDestination, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains([]string{"tcp", "udp", "pickle", "nop"}, u.Scheme) {
+		return nil, errors.New("protocol " + u.Scheme + " not supported in destination " + destination + ", use tcp/udp/pickle/nop")
+	}
+	host, portString, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %s: %v", destination, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in destination %s: %v", destination, err)
+	}
+
+	mirror := &mirrorDestination{
+		name:     destination,
+		protocol: u.Scheme,
+		host:     host,
+		port:     port,
+		retries:  defaultRetries,
+		stats:    new(destinationStats),
+	}
+	if err := mirror.parseQuery(u.Query()); err != nil {
+		return nil, err
+	}
+	return mirror, nil
+}
+
+// parseQuery sets the retries and tls options of the destination
+func (mirror *mirrorDestination) parseQuery(query url.Values) error {
+	var err error
+	if retries := query.Get("retries"); retries != "" {
+		mirror.retries, err = strconv.Atoi(retries)
+		if err != nil || mirror.retries < 1 {
+			return errors.New("invalid retries in destination " + mirror.name)
+		}
+	}
+	if useTLS := query.Get("tls"); useTLS != "" {
+		mirror.tls, err = strconv.ParseBool(useTLS)
+		if err != nil {
+			return errors.New("invalid tls in destination " + mirror.name)
+		}
+		if mirror.tls && mirror.protocol != "tcp" && mirror.protocol != "pickle" {
+			return errors.New("TLS is not supported in destination " + mirror.name + ", use tcp/pickle")
+		}
+	}
+	return nil
+}
+
+// mirrorTarget is a connected destination of a Mirror, counting the
+// reconnections made when a batch fails
+type mirrorTarget struct {
+	destination *mirrorDestination
+	sender      Sender
+	reconnects  *atomic.Int64
+}
+
+func (target *mirrorTarget) Connect() error {
+	target.reconnects.Add(1)
+	return target.sender.Connect()
+}
+
+func (target *mirrorTarget) Disconnect() error {
+	return target.sender.Disconnect()
+}
+
+func (target *mirrorTarget) SendMetrics(metrics []Metric) error {
+	return target.sender.SendMetrics(metrics)
+}
+
+// Mirror sends every batch to several destinations, retrying each one
+// according to its own policy
+type Mirror struct {
+	targets []mirrorTarget
+}
+
+// NewMirror returns a Mirror sending to primary, with the given retries and
+// stats, and to every mirror destination. The mirror destinations use
+// tlsOptions when they enable TLS. The reconnections made by the retries of
+// every destination are added to reconnects.
+func NewMirror(
+	primary Sender,
+	primaryName string,
+	primaryRetries int,
+	primaryStats *destinationStats,
+	destinations []*mirrorDestination,
+	tlsOptions *TLSOptions,
+	reconnects *atomic.Int64,
+) (*Mirror, error) {
+	mirror := &Mirror{
+		targets: []mirrorTarget{{
+			destination: &mirrorDestination{name: primaryName, retries: primaryRetries, stats: primaryStats},
+			sender:      primary,
+			reconnects:  reconnects,
+		}},
+	}
+	for _, destination := range destinations {
+		var destinationTLS *TLSOptions
+		if destination.tls {
+			destinationTLS = tlsOptions
+			if destinationTLS == nil {
+				destinationTLS = &TLSOptions{}
+			}
+		}
+		sender, err := GraphiteFactoryWithTLS(destination.protocol, destination.host, destination.port, "", destinationTLS)
+		if err != nil {
+			mirror.Disconnect()
+			return nil, fmt.Errorf("%s: %v", destination.name, err)
+		}
+		mirror.targets = append(mirror.targets, mirrorTarget{destination: destination, sender: sender, reconnects: reconnects})
+	}
+	return mirror, nil
+}
+
+// Connect reconnects every destination
+func (mirror *Mirror) Connect() error {
+	var errs []error
+	for _, target := range mirror.targets {
+		errs = append(errs, target.sender.Connect())
+	}
+	return errors.Join(errs...)
+}
+
+// Disconnect closes the connection to every destination
+func (mirror *Mirror) Disconnect() error {
+	var errs []error
+	for _, target := range mirror.targets {
+		errs = append(errs, target.sender.Disconnect())
+	}
+	return errors.Join(errs...)
+}
+
+// SendMetrics sends the batch to every destination, a failing destination
+// does not prevent the others from receiving it. Only a failure of the
+// primary destination fails the batch, the failures of the mirrors are
+// counted in their stats.
+func (mirror *Mirror) SendMetrics(metrics []Metric) error {
+	name := ""
+	if len(metrics) > 0 {
+		name = metrics[0].Name
+	}
+
+	var primaryErr error
+	for i := range mirror.targets {
+		target := &mirror.targets[i]
+		destination := target.destination
+		err := sendMetricsWithRetry(target, metrics, name+" ("+destination.name+")", destination.retries)
+		if err != nil {
+			// A destination that cannot be reconnected does not stop the
+			// worker, it is reconnected again with the next batch
+			destination.stats.failedBatches.Add(1)
+			destination.stats.failedPoints.Add(int64(len(metrics)))
+			if i == 0 {
+				primaryErr = fmt.Errorf("%s: %v", destination.name, err)
+			}
+			continue
+		}
+		destination.stats.sentBatches.Add(1)
+		destination.stats.sentPoints.Add(int64(len(metrics)))
+	}
+	return primaryErr
+}
+
+// logDestinationStats logs the outcome of every destination at the end of a run
+func logDestinationStats(primaryName string, primaryStats *destinationStats, destinations []*mirrorDestination) {
+	log.Printf("Destination %s: %s", primaryName, primaryStats)
+	for _, destination := range destinations {
+		log.Printf("Destination %s: %s", destination.name, destination.stats)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// failingSender is a Sender whose batches always fail
+type failingSender struct {
+	attempts int
+}
+
+func (sender *failingSender) Connect() error    { return nil }
+func (sender *failingSender) Disconnect() error { return nil }
+func (sender *failingSender) SendMetrics(metrics []Metric) error {
+	sender.attempts++
+	return errors.New("connection refused")
+}
+
+func TestParseMirrorDestination(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		destination string
+		want        mirrorDestination
+	}{
+		{"pickle://staging:2004?retries=5&tls=true", mirrorDestination{protocol: "pickle", host: "staging", port: 2004, retries: 5, tls: true}},
+		{"udp://[::1]:2003", mirrorDestination{protocol: "udp", host: "::1", port: 2003, retries: 3}},
+	}
+	for _, tt := range tests {
+		destination, err := parseMirrorDestination(tt.destination, 3)
+		if err != nil {
+			t.Fatalf("parseMirrorDestination(%q) error = %v", tt.destination, err)
+		}
+		got := *destination
+		got.stats = nil
+		want := tt.want
+		want.name = tt.destination
+		if got != want {
+			t.Errorf("parseMirrorDestination(%q) = %+v, want %+v", tt.destination, got, want)
+		}
+	}
+
+	for _, invalid := range []string{
+		"http://staging:2004",
+		"tcp://staging",
+		"tcp://staging:port",
+		"tcp://staging:2003?retries=0",
+		"udp://staging:2003?tls=true",
+		"tcp://staging:2003?tls=maybe",
+	} {
+		if _, err := parseMirrorDestination(invalid, 3); err == nil {
+			t.Errorf("expected error for destination %q", invalid)
+		}
+	}
+}
+
+func TestMirrorSendMetrics(t *testing.T) {
+	t.Parallel()
+
+	primaryStats := new(destinationStats)
+	staging := &mirrorDestination{name: "nop://staging:2003", protocol: "nop", host: "staging", port: 2003, retries: 1, stats: new(destinationStats)}
+	broken := &failingSender{}
+	var reconnects atomic.Int64
+	mirror, err := NewMirror(broken, "tcp://primary:2003", 2, primaryStats, []*mirrorDestination{staging}, nil, &reconnects)
+	if err != nil {
+		t.Fatalf("NewMirror() error = %v", err)
+	}
+	mirror.targets[1].sender.(*Graphite).DisableLog = true
+
+	metrics := []Metric{
+		NewMetric("test.metric", "1", 1234567890),
+		NewMetric("test.metric", "2", 1234567950),
+	}
+	if err := mirror.SendMetrics(metrics); err == nil {
+		t.Error("expected error when a destination fails")
+	}
+
+	if broken.attempts != 2 {
+		t.Errorf("expected the primary to be attempted 2 times, got %d", broken.attempts)
+	}
+	if reconnects.Load() != 1 {
+		t.Errorf("expected the primary to be reconnected once, got %d", reconnects.Load())
+	}
+	if got, want := primaryStats.String(), "0 batches (0 points) sent, 1 batches (2 points) failed"; got != want {
+		t.Errorf("unexpected primary stats: %s, want %s", got, want)
+	}
+	if got, want := staging.stats.String(), "1 batches (2 points) sent, 0 batches (0 points) failed"; got != want {
+		t.Errorf("unexpected staging stats: %s, want %s", got, want)
+	}
+	if err := mirror.Disconnect(); err != nil {
+		t.Errorf("Disconnect() error = %v", err)
+	}
+}
+
+func TestMirrorSendMetricsMirrorFails(t *testing.T) {
+	t.Parallel()
+
+	primaryStats := new(destinationStats)
+	staging := &mirrorDestination{name: "nop://staging:2003", protocol: "nop", host: "staging", port: 2003, retries: 2, stats: new(destinationStats)}
+	primary := &recordingSender{}
+	var reconnects atomic.Int64
+	mirror, err := NewMirror(primary, "tcp://primary:2003", 1, primaryStats, []*mirrorDestination{staging}, nil, &reconnects)
+	if err != nil {
+		t.Fatalf("NewMirror() error = %v", err)
+	}
+	broken := &failingSender{}
+	mirror.targets[1].sender = broken
+
+	metrics := []Metric{NewMetric("test.metric", "1", 1234567890)}
+	if err := mirror.SendMetrics(metrics); err != nil {
+		t.Errorf("expected a failing mirror not to fail the batch, got %v", err)
+	}
+	if len(primary.metrics) != 1 || broken.attempts != 2 {
+		t.Errorf("expected the primary to receive the batch and the mirror to be attempted 2 times, got %d and %d", len(primary.metrics), broken.attempts)
+	}
+	if got, want := primaryStats.String(), "1 batches (1 points) sent, 0 batches (0 points) failed"; got != want {
+		t.Errorf("unexpected primary stats: %s, want %s", got, want)
+	}
+	if got, want := staging.stats.String(), "0 batches (0 points) sent, 1 batches (1 points) failed"; got != want {
+		t.Errorf("unexpected staging stats: %s, want %s", got, want)
+	}
+}
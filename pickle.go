@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// Pickle opcodes (protocol 2) used to encode carbon pickle messages
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// pickleMaxLength is the maximum size of a single pickle message, matching the
+// default PICKLE_RECEIVER_MAX_LENGTH of carbon
+const pickleMaxLength = 1 << 20
+
+// pickleBatch accumulates metrics into a pickled list of
+// (path, (timestamp, value)) tuples, as expected by the carbon pickle receiver
+type pickleBatch struct {
+	buf   bytes.Buffer
+	count int
+}
+
+func newPickleBatch() *pickleBatch {
+	batch := new(pickleBatch)
+	batch.buf.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	return batch
+}
+
+// add appends a metric to the pickled list
+func (batch *pickleBatch) add(path string, timestamp int64, value string) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+
+	batch.writeString(path)
+	batch.writeInt(timestamp)
+	batch.writeFloat(v)
+	batch.buf.Write([]byte{pickleTuple2, pickleTuple2})
+	batch.count++
+	return nil
+}
+
+// Len returns the size of the encoded message, without the length header
+func (batch *pickleBatch) Len() int {
+	return batch.buf.Len() + 2
+}
+
+// Bytes terminates the list and returns the length-prefixed message
+func (batch *pickleBatch) Bytes() []byte {
+	batch.buf.Write([]byte{pickleAppends, pickleStop})
+	message := make([]byte, 4, 4+batch.buf.Len())
+	binary.BigEndian.PutUint32(message, uint32(batch.buf.Len())) // #nosec G115 -- bounded by pickleMaxLength
+	return append(message, batch.buf.Bytes()...)
+}
+
+func (batch *pickleBatch) writeString(s string) {
+	batch.buf.WriteByte(pickleBinUnicode)
+	batch.buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(s)))) // #nosec G115 -- metric names are short
+	batch.buf.WriteString(s)
+}
+
+func (batch *pickleBatch) writeInt(i int64) {
+	if i >= math.MinInt32 && i <= math.MaxInt32 {
+		batch.buf.WriteByte(pickleBinInt)
+		batch.buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(int32(i)))) // #nosec G115 -- range checked above
+		return
+	}
+	batch.buf.Write([]byte{pickleLong1, 8})
+	batch.buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(i))) // #nosec G115 -- two's complement encoding
+}
+
+func (batch *pickleBatch) writeFloat(f float64) {
+	batch.buf.WriteByte(pickleBinFloat)
+	batch.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestPickleBatch(t *testing.T) {
+	t.Parallel()
+
+	batch := newPickleBatch()
+	if err := batch.add("a.b", 1234567890, "2.5"); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if err := batch.add("c", 5000000000, "-1"); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if batch.count != 2 {
+		t.Errorf("expected 2 metrics in batch, got %d", batch.count)
+	}
+
+	// pickle.loads() of the payload gives
+	// [('a.b', (1234567890, 2.5)), ('c', (5000000000, -1.0))]
+	expected, _ := hex.DecodeString("00000039" +
+		"80025d28" +
+		"5803000000612e62" + "4ad2029649" + "474004000000000000" + "8686" +
+		"580100000063" + "8a0800f2052a01000000" + "47bff0000000000000" + "8686" +
+		"652e")
+	if got := batch.Bytes(); !bytes.Equal(got, expected) {
+		t.Errorf("Bytes() = %x, want %x", got, expected)
+	}
+}
+
+func TestPickleBatchInvalidValue(t *testing.T) {
+	t.Parallel()
+
+	batch := newPickleBatch()
+	if err := batch.add("a.b", 1234567890, "not a number"); err == nil {
+		t.Error("expected error for a non numeric value")
+	}
+}
+
+func TestSendMetricsPickle(t *testing.T) {
+	t.Parallel()
+
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	g := &Graphite{
+		conn:     conn1,
+		Protocol: "pickle",
+		Prefix:   "prefix",
+	}
+
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, 1024)
+		n, err := conn2.Read(buf)
+		if err != nil {
+			t.Errorf("Error reading from mock connection: %v", err)
+		}
+		received <- buf[:n]
+	}()
+
+	metrics := []Metric{
+		{},
+		NewMetric("test.metric", "10", 1234567890),
+	}
+	if err := g.SendMetrics(metrics); err != nil {
+		t.Errorf("SendMetrics() with pickle protocol error = %v", err)
+	}
+
+	message := <-received
+	if !bytes.Contains(message, []byte("prefix.test.metric")) {
+		t.Errorf("expected prefixed metric name in pickle message, got %x", message)
+	}
+	if int(message[3]) != len(message)-4 {
+		t.Errorf("expected length header %d, got %d", len(message)-4, message[3])
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backoff between two connection attempts of a worker, doubled after every
+// failure
+const (
+	connectBackoffMin = time.Second
+	connectBackoffMax = 30 * time.Second
+)
+
+// taskGroup runs goroutines sharing a context, in the style of errgroup: the
+// first error returned by a goroutine cancels the context and is returned by
+// Wait
+type taskGroup struct {
+	wg     sync.WaitGroup
+	cancel context.CancelCauseFunc
+	once   sync.Once
+	err    error
+}
+
+func newTaskGroup(ctx context.Context) (*taskGroup, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &taskGroup{cancel: cancel}, ctx
+}
+
+// Go runs task in a new goroutine
+func (group *taskGroup) Go(task func() error) {
+	group.wg.Go(func() {
+		if err := task(); err != nil {
+			group.once.Do(func() {
+				group.err = err
+				group.cancel(err)
+			})
+		}
+	})
+}
+
+// Wait waits for every goroutine and returns the first error
+func (group *taskGroup) Wait() error {
+	group.wg.Wait()
+	group.cancel(nil)
+	return group.err
+}
+
+// migration holds the settings shared by the workers of a run
+type migration struct {
+	roots     *sourceRoots
+	filter    *metricFilter
+	rewriter  *metricRewriter
+	newSender func() (Sender, error)
+	fromTs    int
+	toTs      int
+	archives  archiveSelection
+	size      batchSize
+	// sendRetries is the number of attempts of every batch, connectAttempts
+	// the number of consecutive attempts a worker makes to connect
+	sendRetries     int
+	connectAttempts int
+	rateLimiter     *rateLimiter
+	journal         *journal
+	follow          bool
+	// fillDirectory is the destination tree whose gaps are filled with the
+	// whisper files instead of sending them
+	fillDirectory string
+	stats         *runStats
+	report        *runReport
+}
+
+// process sends one whisper file, unless it is filtered out or already sent,
+// and returns the error of a failed transfer
+func (m *migration) process(id int, sender Sender, path string) error {
+	// Filtered metrics are skipped before the file is opened
+	metricName, err := convertFilename(path, m.roots.base(path))
+	if err == nil && !m.filter.match(metricName) {
+		m.stats.fileSkipped()
+		return nil
+	}
+	if entry, ok := m.journal.lookup(path, ""); ok && entry.done && !m.follow {
+		log.Println("SKIP: " + path)
+		m.stats.fileSkipped()
+		return nil
+	}
+
+	m.stats.setWorkerState(id, workerSending)
+	defer m.stats.setWorkerState(id, workerIdle)
+	start := time.Now()
+	entry := &fileReport{Path: path, Metric: metricName}
+	err = m.transfer(sender, path, entry)
+	if errors.Is(err, errNoFillDestination) {
+		log.Println("SKIP: " + err.Error())
+		m.stats.fileSkipped()
+		return nil
+	}
+	entry.Duration = time.Since(start).Seconds()
+	if err != nil {
+		log.Println(err)
+		entry.Error = err.Error()
+	} else {
+		log.Println("OK: " + path)
+	}
+	m.stats.fileDone(err)
+	if err := m.report.add(entry); err != nil {
+		log.Printf("Failed to write the report entry of %v: %v", path, err)
+	}
+	return err
+}
+
+// transfer sends a whisper file, or fills the file of the same metric in the
+// destination tree with it
+func (m *migration) transfer(sender Sender, path string, entry *fileReport) error {
+	if m.fillDirectory == "" {
+		return sendWhisperData(path, m.roots, sender, m.fromTs, m.toTs, m.archives, m.size, m.sendRetries, m.rateLimiter, m.journal, m.rewriter, entry)
+	}
+	err := fillWhisperFile(path, m.roots, m.fillDirectory, m.fromTs, m.toTs, m.journal, entry)
+	m.stats.points.Add(entry.PointsSent)
+	return err
+}
+
+// connect creates the sender of a worker, retrying with an exponential
+// backoff up to connectAttempts times
+func (m *migration) connect(ctx context.Context, id int) (Sender, error) {
+	backoff := connectBackoffMin
+	for attempt := 1; ; attempt++ {
+		m.stats.setWorkerState(id, workerConnecting)
+		sender, err := m.newSender()
+		if err == nil {
+			return sender, nil
+		}
+
+		m.stats.setWorkerState(id, workerFailed)
+		if attempt >= m.connectAttempts {
+			return nil, err
+		}
+		log.Printf("Worker %d failed to connect to graphite: %v, retrying in %v", id, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(2*backoff, connectBackoffMax)
+	}
+}
+
+// worker sends the files received from ch until it is closed or ctx is done.
+// When its destination is lost it connects again, and stops with an error
+// when it cannot.
+func (m *migration) worker(ctx context.Context, id int, ch <-chan string) error {
+	sender, err := m.connect(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sender.Disconnect()
+	}()
+	defer m.stats.setWorkerState(id, workerStopped)
+
+	m.stats.setWorkerState(id, workerIdle)
+	for {
+		select {
+		case path, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := m.process(id, sender, path); !errors.Is(err, errReconnectFailed) {
+				continue
+			}
+			log.Printf("Worker %d lost its connection to graphite, connecting again", id)
+			m.stats.reconnects.Add(1)
+			reconnected, err := m.connect(ctx, id)
+			if err != nil {
+				return err
+			}
+			sender.Disconnect()
+			sender = reconnected
+			m.stats.setWorkerState(id, workerIdle)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// run starts scan, which sends the whisper files to ch, and the workers
+// processing them. ch is closed when the scan ends. The run stops when every
+// file is processed, when ctx is done, when the scan fails or when no worker
+// is able to connect anymore, the first error is returned.
+func (m *migration) run(ctx context.Context, workers int, ch chan string, scan func(context.Context, chan<- string) error) error {
+	group, ctx := newTaskGroup(ctx)
+	group.Go(func() error {
+		defer close(ch)
+		return scan(ctx, ch)
+	})
+
+	var alive atomic.Int64
+	alive.Store(int64(workers))
+	for id := range workers {
+		group.Go(func() error {
+			err := m.worker(ctx, id, ch)
+			if err == nil || ctx.Err() != nil {
+				return nil
+			}
+			if alive.Add(-1) > 0 {
+				log.Printf("Worker %d stopped: %v", id, err)
+				return nil
+			}
+			return fmt.Errorf("no worker is able to connect to graphite: %w", err)
+		})
+	}
+	return group.Wait()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+func TestTaskGroup(t *testing.T) {
+	t.Parallel()
+
+	group, ctx := newTaskGroup(context.Background())
+	failure := errors.New("scan failed")
+	group.Go(func() error {
+		return failure
+	})
+	group.Go(func() error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	group.Go(func() error {
+		return nil
+	})
+	if err := group.Wait(); err != failure {
+		t.Errorf("Wait() = %v, want %v", err, failure)
+	}
+	if !errors.Is(context.Cause(ctx), failure) {
+		t.Errorf("expected the context to be canceled by the first error, got %v", context.Cause(ctx))
+	}
+}
+
+// newTestMigration returns a migration of the whisper files created in a
+// temporary directory, sending them with newSender
+func newTestMigration(t *testing.T, files int, newSender func() (Sender, error)) (*migration, string) {
+	t.Helper()
+
+	now := int(time.Now().Unix())
+	baseDir := t.TempDir()
+	for i := 0; i < files; i++ {
+		path := filepath.Join(baseDir, "metric"+strings.Repeat("x", i)+".wsp")
+		createWhisperFile(t, path, "1m:1h", []*whisper.TimeSeriesPoint{{Time: now - 120, Value: 1}})
+	}
+	j, err := newJournal("", false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	return &migration{
+		roots:           testRoots(baseDir),
+		filter:          &metricFilter{},
+		rewriter:        &metricRewriter{},
+		newSender:       newSender,
+		fromTs:          0,
+		toTs:            2147483647,
+		archives:        archiveSelection{mode: archivesFetch, index: -1},
+		size:            batchSize{points: 10000},
+		sendRetries:     1,
+		connectAttempts: 1,
+		rateLimiter:     newRateLimiter(0, 0, time.Second),
+		journal:         j,
+		stats:           newRunStats(2),
+	}, baseDir
+}
+
+func newNopSender() (Sender, error) {
+	nop := NewGraphiteNop("localhost", 2003)
+	nop.DisableLog = true
+	return nop, nil
+}
+
+func TestMigrationRun(t *testing.T) {
+	t.Parallel()
+
+	m, baseDir := newTestMigration(t, 3, newNopSender)
+	scan := func(ctx context.Context, ch chan<- string) error {
+		return findWhisperFiles(ctx, ch, baseDir)
+	}
+	if err := m.run(context.Background(), 2, make(chan string, 1), scan); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if sent := m.stats.sent.Load(); sent != 3 {
+		t.Errorf("expected 3 files sent, got %d", sent)
+	}
+	for id := range m.stats.workers {
+		if state := m.stats.workers[id].Load(); state != workerStopped {
+			t.Errorf("expected worker %d to be stopped, got state %d", id, state)
+		}
+	}
+}
+
+func TestMigrationRunNoWorker(t *testing.T) {
+	t.Parallel()
+
+	m, baseDir := newTestMigration(t, 5, func() (Sender, error) {
+		return nil, errors.New("connection refused")
+	})
+	scan := func(ctx context.Context, ch chan<- string) error {
+		return findWhisperFiles(ctx, ch, baseDir)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.run(context.Background(), 2, make(chan string), scan)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "no worker is able to connect") {
+			t.Errorf("expected a fatal error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run() hangs when no worker can connect")
+	}
+	if files := m.stats.files.Load(); files != 0 {
+		t.Errorf("expected no file to be processed, got %d", files)
+	}
+}
+
+func TestMigrationRunSurvivingWorker(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int64
+	m, baseDir := newTestMigration(t, 3, func() (Sender, error) {
+		if calls.Add(1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return newNopSender()
+	})
+	scan := func(ctx context.Context, ch chan<- string) error {
+		return findWhisperFiles(ctx, ch, baseDir)
+	}
+	if err := m.run(context.Background(), 2, make(chan string), scan); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if sent := m.stats.sent.Load(); sent != 3 {
+		t.Errorf("expected the remaining worker to send 3 files, got %d", sent)
+	}
+}
+
+// closingDestination is a destination that closes after its first batch and
+// refuses every connection from then on
+type closingDestination struct {
+	closed atomic.Bool
+}
+
+func (destination *closingDestination) newSender() (Sender, error) {
+	if destination.closed.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return &closingSender{destination: destination}, nil
+}
+
+// closingSender is a connection to a closingDestination
+type closingSender struct {
+	destination *closingDestination
+}
+
+func (sender *closingSender) Connect() error {
+	if sender.destination.closed.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (sender *closingSender) Disconnect() error { return nil }
+
+func (sender *closingSender) SendMetrics(metrics []Metric) error {
+	if sender.destination.closed.Swap(true) {
+		return errors.New("broken pipe")
+	}
+	return nil
+}
+
+func TestMigrationRunDestinationLost(t *testing.T) {
+	t.Parallel()
+
+	destination := &closingDestination{}
+	m, baseDir := newTestMigration(t, 5, destination.newSender)
+	m.sendRetries = 2
+	m.connectAttempts = 2
+	scan := func(ctx context.Context, ch chan<- string) error {
+		return findWhisperFiles(ctx, ch, baseDir)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.run(context.Background(), 2, make(chan string), scan)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "no worker is able to connect") {
+			t.Errorf("expected a fatal error, got %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("run() does not stop when the destination is lost")
+	}
+	if sent, failed := m.stats.sent.Load(), m.stats.failed.Load(); sent != 1 || failed > 2 {
+		t.Errorf("expected the run to stop after the first file, got %d sent and %d failed", sent, failed)
+	}
+}
+
+func TestMigrationConnectRetry(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int64
+	m, _ := newTestMigration(t, 0, func() (Sender, error) {
+		if calls.Add(1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return newNopSender()
+	})
+	m.connectAttempts = 2
+
+	start := time.Now()
+	sender, err := m.connect(context.Background(), 0)
+	if err != nil || sender == nil {
+		t.Fatalf("connect() = %v, %v", sender, err)
+	}
+	if elapsed := time.Since(start); elapsed < connectBackoffMin {
+		t.Errorf("expected to wait %v before retrying, waited %v", connectBackoffMin, elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls.Store(0)
+	if _, err := m.connect(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the backoff to stop with the context, got %v", err)
+	}
+}
+
+func TestMigrationRunCanceled(t *testing.T) {
+	t.Parallel()
+
+	m, baseDir := newTestMigration(t, 1, newNopSender)
+	m.follow = true
+	scan := func(ctx context.Context, ch chan<- string) error {
+		return followWhisperFiles(ctx, ch, testRoots(baseDir), baseDir, time.Hour)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- m.run(ctx, 2, make(chan string), scan)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run() did not stop with its context")
+	}
+	if sent := m.stats.sent.Load(); sent != 1 {
+		t.Errorf("expected the file to be sent before stopping, got %d", sent)
+	}
+}
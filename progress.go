@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressReporter reports the files and points migrated so far. On a
+// terminal it keeps a status line at the bottom of the output, refreshed
+// every second, otherwise the status is logged at an interval. It is also the
+// output of the log package, so that log lines do not garble the status.
+type progressReporter struct {
+	out   io.Writer
+	tty   bool
+	start time.Time
+	stats *runStats
+	// total is the number of files found by the pre-scan, -1 when unknown
+	total    atomic.Int64
+	counting atomic.Bool
+
+	lock sync.Mutex
+	line string
+}
+
+// newProgressReporter writes the progress of stats to out, as a status line
+// when out is a terminal
+func newProgressReporter(out *os.File, stats *runStats) *progressReporter {
+	progress := &progressReporter{
+		out:   out,
+		tty:   isTerminal(out),
+		start: time.Now(),
+		stats: stats,
+	}
+	progress.total.Store(-1)
+	return progress
+}
+
+// isTerminal reports whether the file is a character device
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// countWhisperFiles returns the number of whisper files below directory, a
+// metric held by several roots being counted once
+func countWhisperFiles(roots *sourceRoots, directory string) (int64, error) {
+	ch := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- roots.find(context.Background(), ch, directory)
+		close(ch)
+	}()
+	count := int64(0)
+	for range ch {
+		count++
+	}
+	return count, <-errs
+}
+
+// countFiles pre-scans directory to know how many files the run will process
+func (progress *progressReporter) countFiles(roots *sourceRoots, directory string) {
+	progress.counting.Store(true)
+	defer progress.counting.Store(false)
+	count, err := countWhisperFiles(roots, directory)
+	if err != nil {
+		log.Printf("Failed to count the whisper files: %v", err)
+		return
+	}
+	progress.total.Store(count)
+}
+
+// humanCount formats a count with a k/M/G suffix
+func humanCount(n float64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", n/1e3)
+	}
+	return fmt.Sprintf("%.0f", n)
+}
+
+// status describes the progress at the given time
+func (progress *progressReporter) status(now time.Time) string {
+	elapsed := now.Sub(progress.start)
+	files := progress.stats.files.Load()
+	total := progress.total.Load()
+	points := progress.stats.points.Load()
+
+	var status strings.Builder
+	if total >= 0 {
+		percent := 100.0
+		if total > 0 {
+			percent = 100 * float64(files) / float64(total)
+		}
+		fmt.Fprintf(&status, "Progress: %d/%d files (%.1f%%)", files, total, percent)
+	} else {
+		fmt.Fprintf(&status, "Progress: %d files", files)
+	}
+	fmt.Fprintf(&status, ", %d failed, %d skipped, %s points", progress.stats.failed.Load(), progress.stats.skipped.Load(), humanCount(float64(points)))
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		fmt.Fprintf(&status, " (%s points/s)", humanCount(float64(points)/seconds))
+	}
+	switch {
+	case progress.counting.Load():
+		status.WriteString(", ETA unknown while counting files")
+	case total >= 0 && files > 0 && files < total:
+		remaining := time.Duration(float64(elapsed) / float64(files) * float64(total-files))
+		fmt.Fprintf(&status, ", ETA %v", remaining.Round(time.Second))
+	}
+	return status.String()
+}
+
+// Write writes a log line above the status line
+func (progress *progressReporter) Write(p []byte) (int, error) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+
+	if !progress.tty || progress.line == "" {
+		return progress.out.Write(p)
+	}
+	if _, err := io.WriteString(progress.out, "\r\x1b[K"); err != nil {
+		return 0, err
+	}
+	n, err := progress.out.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(progress.out, progress.line)
+	return n, err
+}
+
+// report shows the current status, redrawing the status line on a terminal
+func (progress *progressReporter) report() {
+	status := progress.status(time.Now())
+	if !progress.tty {
+		log.Println(status)
+		return
+	}
+
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	progress.line = status
+	_, _ = io.WriteString(progress.out, "\r\x1b[K"+status)
+}
+
+// run reports the progress every second on a terminal, every interval
+// otherwise, forever
+func (progress *progressReporter) run(interval time.Duration) {
+	if progress.tty {
+		interval = time.Second
+	}
+	for {
+		time.Sleep(interval)
+		progress.report()
+	}
+}
+
+// finish reports the final status, leaving it on its own line
+func (progress *progressReporter) finish() {
+	progress.report()
+	if progress.tty {
+		progress.lock.Lock()
+		defer progress.lock.Unlock()
+		progress.line = ""
+		_, _ = io.WriteString(progress.out, "\n")
+	}
+}
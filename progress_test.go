@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressStatus(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1700000000, 0)
+	stats := newRunStats(1)
+	progress := &progressReporter{start: start, stats: stats}
+	progress.total.Store(-1)
+	progress.counting.Store(true)
+	stats.fileDone(nil)
+	stats.points.Add(1500)
+
+	want := "Progress: 1 files, 0 failed, 0 skipped, 1.5k points (150 points/s), ETA unknown while counting files"
+	if got := progress.status(start.Add(10 * time.Second)); got != want {
+		t.Errorf("status() = %q, want %q", got, want)
+	}
+
+	progress.counting.Store(false)
+	progress.total.Store(4)
+	stats.fileDone(errors.New("broken pipe"))
+	stats.fileSkipped()
+	stats.points.Add(2500000 - 1500)
+
+	want = "Progress: 3/4 files (75.0%), 1 failed, 1 skipped, 2.5M points (250.0k points/s), ETA 3s"
+	if got := progress.status(start.Add(10 * time.Second)); got != want {
+		t.Errorf("status() = %q, want %q", got, want)
+	}
+
+	stats.fileDone(nil)
+	if got := progress.status(start.Add(10 * time.Second)); strings.Contains(got, "ETA") {
+		t.Errorf("expected no ETA once every file is done, got %q", got)
+	}
+}
+
+func TestProgressWriteTerminal(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	progress := &progressReporter{out: &out, tty: true, start: time.Now(), stats: newRunStats(1)}
+	progress.total.Store(-1)
+
+	if _, err := progress.Write([]byte("first\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	progress.report()
+	progress.line = "status"
+	out.Reset()
+	if _, err := progress.Write([]byte("OK: foo.wsp\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got, want := out.String(), "\r\x1b[KOK: foo.wsp\nstatus"; got != want {
+		t.Errorf("Write() wrote %q, want %q", got, want)
+	}
+
+	out.Reset()
+	progress.finish()
+	if got := out.String(); !strings.HasPrefix(got, "\r\x1b[KProgress: ") || !strings.HasSuffix(got, "\n") || progress.line != "" {
+		t.Errorf("finish() wrote %q, line %q", got, progress.line)
+	}
+}
+
+func TestCountWhisperFiles(t *testing.T) {
+	t.Parallel()
+
+	baseDir := t.TempDir()
+	createTestFiles(t, baseDir, []string{
+		filepath.Join(baseDir, "a.wsp"),
+		filepath.Join(baseDir, "subdir", "b.wsp"),
+		filepath.Join(baseDir, "subdir", "c.txt"),
+	})
+
+	progress := &progressReporter{}
+	progress.total.Store(-1)
+	progress.countFiles(testRoots(baseDir), baseDir)
+	if total := progress.total.Load(); total != 2 {
+		t.Errorf("expected 2 whisper files, got %d", total)
+	}
+	if progress.counting.Load() {
+		t.Error("expected counting to be over")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsNamespace prefixes every metric served on /metrics
+const metricsNamespace = "whisper_to_graphite_"
+
+// namedStats are the stats of a destination labelled with its name
+type namedStats struct {
+	name  string
+	stats *destinationStats
+}
+
+// metricsHandler serves the internals of the migration in the Prometheus text
+// exposition format
+type metricsHandler struct {
+	stats        *runStats
+	limiter      *rateLimiter
+	queue        chan string
+	destinations []namedStats
+}
+
+// labelEscaper escapes label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// exposition writes metrics in the Prometheus text format
+type exposition struct {
+	w io.Writer
+}
+
+// family writes the HELP and TYPE lines of a metric family
+func (e exposition) family(name string, kind string, help string) {
+	fmt.Fprintf(e.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsNamespace, name, help, metricsNamespace, name, kind)
+}
+
+// sample writes one sample, labels are given as name and value pairs
+func (e exposition) sample(name string, value float64, labels ...string) {
+	var line strings.Builder
+	line.WriteString(metricsNamespace + name)
+	if len(labels) > 0 {
+		line.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				line.WriteString(",")
+			}
+			line.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		line.WriteString("}")
+	}
+	line.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+	_, _ = io.WriteString(e.w, line.String())
+}
+
+func (handler *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e := exposition{w: w}
+	stats := handler.stats
+
+	e.family("files_total", "counter", "Whisper files processed, by result.")
+	e.sample("files_total", float64(stats.sent.Load()), "result", "ok")
+	e.sample("files_total", float64(stats.failed.Load()), "result", "failed")
+	e.sample("files_total", float64(stats.skipped.Load()), "result", "skipped")
+
+	e.family("points_sent_total", "counter", "Points confirmed by the destination.")
+	e.sample("points_sent_total", float64(stats.points.Load()))
+
+	e.family("bytes_sent_total", "counter", "Bytes confirmed by the destination, measured as plaintext protocol lines.")
+	e.sample("bytes_sent_total", float64(stats.bytes.Load()))
+
+	e.family("reconnects_total", "counter", "Reconnections made after a failed batch, to any destination.")
+	e.sample("reconnects_total", float64(stats.reconnects.Load()))
+
+	e.family("rate_limiter_waits_total", "counter", "Batches delayed by the rate limiter.")
+	e.sample("rate_limiter_waits_total", float64(handler.limiter.waits.Load()))
+
+	e.family("rate_limiter_wait_seconds_total", "counter", "Time spent waiting for the rate limiter.")
+	e.sample("rate_limiter_wait_seconds_total", time.Duration(handler.limiter.waited.Load()).Seconds())
+
+	e.family("rate_limiter_points_per_second", "gauge", "Current points per second limit, 0 when not limited.")
+	e.sample("rate_limiter_points_per_second", handler.limiter.pointsPerSecond())
+
+	e.family("file_queue_depth", "gauge", "Whisper files found by the scan and waiting for a worker.")
+	e.sample("file_queue_depth", float64(len(handler.queue)))
+
+	e.family("file_queue_capacity", "gauge", "Maximum number of whisper files waiting for a worker.")
+	e.sample("file_queue_capacity", float64(cap(handler.queue)))
+
+	e.family("worker_state", "gauge", "State of every worker, 1 for the current one.")
+	for id := range stats.workers {
+		current := stats.workers[id].Load()
+		for state, name := range workerStateNames {
+			value := 0.0
+			if int32(state) == current { // #nosec G115 -- a handful of states
+				value = 1
+			}
+			e.sample("worker_state", value, "worker", strconv.Itoa(id), "state", name)
+		}
+	}
+
+	if len(handler.destinations) > 0 {
+		e.family("destination_points_total", "counter", "Points sent to every destination, by result.")
+		for _, destination := range handler.destinations {
+			e.sample("destination_points_total", float64(destination.stats.sentPoints.Load()), "destination", destination.name, "result", "sent")
+			e.sample("destination_points_total", float64(destination.stats.failedPoints.Load()), "destination", destination.name, "result", "failed")
+		}
+		e.family("destination_batches_total", "counter", "Batches sent to every destination, by result.")
+		for _, destination := range handler.destinations {
+			e.sample("destination_batches_total", float64(destination.stats.sentBatches.Load()), "destination", destination.name, "result", "sent")
+			e.sample("destination_batches_total", float64(destination.stats.failedBatches.Load()), "destination", destination.name, "result", "failed")
+		}
+	}
+}
+
+// serveMetrics serves the handler on /metrics at address, in the background
+func serveMetrics(address string, handler *metricsHandler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Fatal(server.ListenAndServe())
+	}()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	t.Parallel()
+
+	stats := newRunStats(2)
+	stats.fileDone(nil)
+	stats.fileDone(nil)
+	stats.fileDone(errors.New("broken pipe"))
+	stats.fileSkipped()
+	stats.points.Add(1500)
+	stats.bytes.Add(42000)
+	stats.reconnects.Add(3)
+	stats.setWorkerState(0, workerSending)
+	stats.setWorkerState(1, workerFailed)
+
+	limiter := newRateLimiter(250, 0, time.Second)
+	limiter.waits.Add(4)
+	limiter.waited.Add(int64(1500 * time.Millisecond))
+
+	queue := make(chan string, 10)
+	queue <- "a.wsp"
+	queue <- "b.wsp"
+
+	mirrorStats := new(destinationStats)
+	mirrorStats.sentPoints.Add(1000)
+	mirrorStats.failedBatches.Add(1)
+	handler := &metricsHandler{
+		stats:        stats,
+		limiter:      limiter,
+		queue:        queue,
+		destinations: []namedStats{{name: `tcp://staging:2003?x="y"`, stats: mirrorStats}},
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE whisper_to_graphite_files_total counter",
+		`whisper_to_graphite_files_total{result="ok"} 2`,
+		`whisper_to_graphite_files_total{result="failed"} 1`,
+		`whisper_to_graphite_files_total{result="skipped"} 1`,
+		"whisper_to_graphite_points_sent_total 1500",
+		"whisper_to_graphite_bytes_sent_total 42000",
+		"whisper_to_graphite_reconnects_total 3",
+		"whisper_to_graphite_rate_limiter_waits_total 4",
+		"whisper_to_graphite_rate_limiter_wait_seconds_total 1.5",
+		"whisper_to_graphite_rate_limiter_points_per_second 250",
+		"# TYPE whisper_to_graphite_file_queue_depth gauge",
+		"whisper_to_graphite_file_queue_depth 2",
+		"whisper_to_graphite_file_queue_capacity 10",
+		`whisper_to_graphite_worker_state{worker="0",state="sending"} 1`,
+		`whisper_to_graphite_worker_state{worker="0",state="idle"} 0`,
+		`whisper_to_graphite_worker_state{worker="1",state="failed"} 1`,
+		`whisper_to_graphite_destination_points_total{destination="tcp://staging:2003?x=\"y\"",result="sent"} 1000`,
+		`whisper_to_graphite_destination_batches_total{destination="tcp://staging:2003?x=\"y\"",result="failed"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected line %q in:\n%s", line, body)
+		}
+	}
+}
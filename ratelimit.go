@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket refills rate tokens per second up to burst. Requests larger
+// than the available tokens leave the bucket in debt, so every caller waits
+// in proportion to what it takes and the average rate is never exceeded.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	burst = max(burst, 1)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait before
+// they are covered by the refill
+func (bucket *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens = min(bucket.burst, bucket.tokens+elapsed.Seconds()*bucket.rate)
+		bucket.last = now
+	}
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// rateLimiter paces the batches of every worker to at most pointsPerSecond
+// points and bytesPerSecond bytes, allowing bursts of burst seconds at the
+// full rate. A zero limit is not enforced.
+type rateLimiter struct {
+	points  *tokenBucket
+	bytes   *tokenBucket
+	lock    sync.Mutex
+	enabled bool
+	burst   time.Duration
+	now     func() time.Time
+	sleep   func(time.Duration)
+	// waits counts the delayed batches and waited the nanoseconds spent
+	// waiting
+	waits  atomic.Int64
+	waited atomic.Int64
+}
+
+func newRateLimiter(pointsPerSecond int64, bytesPerSecond int64, burst time.Duration) *rateLimiter {
+	rl := &rateLimiter{
+		burst: burst,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	now := rl.now()
+	if pointsPerSecond > 0 {
+		rl.points = newTokenBucket(float64(pointsPerSecond), float64(pointsPerSecond)*burst.Seconds(), now)
+	}
+	if bytesPerSecond > 0 {
+		rl.bytes = newTokenBucket(float64(bytesPerSecond), float64(bytesPerSecond)*burst.Seconds(), now)
+	}
+	rl.enabled = rl.points != nil || rl.bytes != nil
+	return rl
+}
+
+// limit blocks until a batch of the given number of points and bytes can be
+// sent. Tokens are reserved under the lock and waited for outside of it, so
+// concurrent workers are served in order without holding each other up.
+func (rl *rateLimiter) limit(points int64, bytes int64) {
+	if !rl.enabled {
+		return
+	}
+
+	rl.lock.Lock()
+	now := rl.now()
+	var wait time.Duration
+	if rl.points != nil {
+		wait = max(wait, rl.points.reserve(float64(points), now))
+	}
+	if rl.bytes != nil {
+		wait = max(wait, rl.bytes.reserve(float64(bytes), now))
+	}
+	rl.lock.Unlock()
+
+	if wait > 0 {
+		rl.waits.Add(1)
+		rl.waited.Add(int64(wait))
+		rl.sleep(wait)
+	}
+}
+
+// burstReached reports whether a batch of the given number of points and
+// bytes takes the whole burst of the limiter. Larger batches would be sent in
+// a single burst over the limits before waiting, so they are sent as soon as
+// they reach it.
+func (rl *rateLimiter) burstReached(points int64, bytes int64) bool {
+	if !rl.enabled {
+		return false
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return (rl.points != nil && float64(points) >= rl.points.burst) ||
+		(rl.bytes != nil && float64(bytes) >= rl.bytes.burst)
+}
+
+// pointsPerSecond returns the current points per second limit, 0 when the
+// points are not limited
+func (rl *rateLimiter) pointsPerSecond() float64 {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.points == nil {
+		return 0
+	}
+	return rl.points.rate
+}
+
+// setPointsPerSecond changes the points per second limit, keeping the tokens
+// already available. It enables the limiter if needed.
+func (rl *rateLimiter) setPointsPerSecond(pointsPerSecond float64) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	burst := max(pointsPerSecond*rl.burst.Seconds(), 1)
+	if rl.points == nil {
+		rl.points = newTokenBucket(pointsPerSecond, burst, rl.now())
+		rl.enabled = true
+		return
+	}
+	rl.points.rate = pointsPerSecond
+	rl.points.burst = burst
+	rl.points.tokens = min(rl.points.tokens, burst)
+}
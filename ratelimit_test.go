@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClockLimiter returns a rate limiter whose clock only moves when it
+// sleeps, and the list of the sleeps it made
+func fakeClockLimiter(pointsPerSecond int64, bytesPerSecond int64, burst time.Duration) (*rateLimiter, *[]time.Duration) {
+	rl := newRateLimiter(pointsPerSecond, bytesPerSecond, burst)
+	clock := time.Unix(1700000000, 0)
+	sleeps := new([]time.Duration)
+	rl.now = func() time.Time { return clock }
+	rl.sleep = func(d time.Duration) {
+		*sleeps = append(*sleeps, d)
+		clock = clock.Add(d)
+	}
+	if rl.points != nil {
+		rl.points.last = clock
+	}
+	if rl.bytes != nil {
+		rl.bytes.last = clock
+	}
+	return rl, sleeps
+}
+
+func TestNewRateLimiter_Enabled(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(100, 0, time.Second)
+	if rl == nil {
+		t.Fatal("expected non-nil rateLimiter")
+	}
+	if !rl.enabled {
+		t.Error("expected rateLimiter to be enabled")
+	}
+	if rl.points == nil || rl.points.rate != 100 || rl.points.burst != 100 || rl.points.tokens != 100 {
+		t.Errorf("expected a full bucket of 100 points, got %+v", rl.points)
+	}
+	if rl.bytes != nil {
+		t.Errorf("expected no bytes bucket, got %+v", rl.bytes)
+	}
+}
+
+func TestNewRateLimiter_Bytes(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(0, 1000, 2*time.Second)
+	if !rl.enabled || rl.points != nil || rl.bytes == nil || rl.bytes.burst != 2000 {
+		t.Errorf("expected only a bytes bucket with a burst of 2000, got %+v and %+v", rl.points, rl.bytes)
+	}
+}
+
+func TestNewRateLimiter_Disabled(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(0, 0, time.Second)
+	if rl == nil {
+		t.Fatal("expected non-nil rateLimiter")
+	}
+	if rl.enabled {
+		t.Error("expected rateLimiter to be disabled")
+	}
+	if rl.points != nil || rl.bytes != nil {
+		t.Errorf("expected no buckets, got %+v and %+v", rl.points, rl.bytes)
+	}
+}
+
+func TestLimitNoTrigger(t *testing.T) {
+	t.Parallel()
+
+	rl, sleeps := fakeClockLimiter(10, 0, time.Second)
+	rl.limit(5, 0)
+	rl.limit(5, 0)
+	if len(*sleeps) != 0 {
+		t.Errorf("expected the burst to cover 10 points, slept %v", *sleeps)
+	}
+}
+
+func TestLimitTrigger(t *testing.T) {
+	t.Parallel()
+
+	rl, sleeps := fakeClockLimiter(10, 0, time.Second)
+	rl.limit(6, 0)
+	rl.limit(6, 0)
+	rl.limit(5, 0)
+	want := []time.Duration{200 * time.Millisecond, 500 * time.Millisecond}
+	if len(*sleeps) != len(want) {
+		t.Fatalf("expected sleeps %v, got %v", want, *sleeps)
+	}
+	for i := range want {
+		if (*sleeps)[i] != want[i] {
+			t.Errorf("sleep %d = %v, want %v", i, (*sleeps)[i], want[i])
+		}
+	}
+}
+
+func TestLimitBytes(t *testing.T) {
+	t.Parallel()
+
+	rl, sleeps := fakeClockLimiter(1000, 100, time.Second)
+	rl.limit(1, 100)
+	rl.limit(1, 300)
+	if len(*sleeps) != 1 || (*sleeps)[0] != 3*time.Second {
+		t.Errorf("expected the bytes limit to wait 3s, got %v", *sleeps)
+	}
+}
+
+func TestBurstReached(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		pointsPerSecond int64
+		bytesPerSecond  int64
+		points          int64
+		bytes           int64
+		want            bool
+	}{
+		{100, 0, 199, 1 << 20, false},
+		{100, 0, 200, 0, true},
+		{0, 1000, 1 << 20, 1999, false},
+		{0, 1000, 1, 2000, true},
+		{0, 0, 1 << 20, 1 << 30, false},
+	}
+	for _, tt := range tests {
+		rl := newRateLimiter(tt.pointsPerSecond, tt.bytesPerSecond, 2*time.Second)
+		if got := rl.burstReached(tt.points, tt.bytes); got != tt.want {
+			t.Errorf("burstReached(%d, %d) at %d points/s and %d bytes/s = %v, want %v", tt.points, tt.bytes, tt.pointsPerSecond, tt.bytesPerSecond, got, tt.want)
+		}
+	}
+}
+
+func TestLimitWhenDisabled(t *testing.T) {
+	t.Parallel()
+
+	rl, sleeps := fakeClockLimiter(0, 0, time.Second)
+	rl.limit(100, 100000)
+	if len(*sleeps) != 0 {
+		t.Errorf("expected no sleep when disabled, got %v", *sleeps)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1700000000, 0)
+	bucket := newTokenBucket(10, 5, start)
+	if wait := bucket.reserve(5, start); wait != 0 {
+		t.Errorf("expected the burst to be available, waited %v", wait)
+	}
+	if wait := bucket.reserve(1, start); wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms for one token, got %v", wait)
+	}
+	if wait := bucket.reserve(2, start.Add(time.Hour)); wait != 0 {
+		t.Errorf("expected refilled tokens after an hour, waited %v", wait)
+	}
+	if bucket.tokens != 3 {
+		t.Errorf("expected the refill to stop at the burst, got %v tokens", bucket.tokens)
+	}
+}
+
+func TestSetPointsPerSecond(t *testing.T) {
+	t.Parallel()
+
+	rl, sleeps := fakeClockLimiter(0, 0, time.Second)
+	rl.setPointsPerSecond(10)
+	if !rl.enabled || rl.points == nil || rl.points.rate != 10 || rl.points.burst != 10 {
+		t.Fatalf("expected an enabled limiter at 10 points/s, got %+v", rl.points)
+	}
+
+	rl.setPointsPerSecond(4)
+	if rl.points.rate != 4 || rl.points.tokens != 4 {
+		t.Errorf("expected the tokens to be capped by the new burst, got %+v", rl.points)
+	}
+	rl.limit(8, 0)
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Second {
+		t.Errorf("expected to wait 1s at the new rate, got %v", *sleeps)
+	}
+}
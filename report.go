@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Formats accepted by the -reportformat flag
+const (
+	reportJSON = "json"
+	reportCSV  = "csv"
+)
+
+// reportHeader names the CSV columns of a file entry
+var reportHeader = []string{"path", "metric", "points_read", "points_sent", "first_timestamp", "last_timestamp", "duration_seconds", "error"}
+
+// fileReport describes the outcome of one whisper file. The timestamps are
+// the ones of the first and last points read in the requested time range.
+type fileReport struct {
+	Path       string  `json:"path"`
+	Metric     string  `json:"metric"`
+	PointsRead int64   `json:"points_read"`
+	PointsSent int64   `json:"points_sent"`
+	FirstTs    int64   `json:"first_timestamp,omitempty"`
+	LastTs     int64   `json:"last_timestamp,omitempty"`
+	Duration   float64 `json:"duration_seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// addPoint records a point read from the file
+func (report *fileReport) addPoint(timestamp int64) {
+	if report.PointsRead == 0 || timestamp < report.FirstTs {
+		report.FirstTs = timestamp
+	}
+	report.LastTs = max(report.LastTs, timestamp)
+	report.PointsRead++
+}
+
+// reportTotals sums the file entries of a run
+type reportTotals struct {
+	Files      int64   `json:"files"`
+	Failed     int64   `json:"failed"`
+	Skipped    int64   `json:"skipped"`
+	PointsRead int64   `json:"points_read"`
+	PointsSent int64   `json:"points_sent"`
+	Duration   float64 `json:"duration_seconds"`
+}
+
+// runReport writes a machine-readable report of a run. Every file entry is
+// written as soon as the file is done, so the report does not grow in memory,
+// and the totals are written by Close.
+type runReport struct {
+	file   *os.File
+	format string
+	start  time.Time
+	stats  *runStats
+
+	lock    sync.Mutex
+	csv     *csv.Writer
+	entries int
+	totals  reportTotals
+}
+
+// newRunReport creates the report file, the skipped files are taken from
+// stats
+func newRunReport(path string, format string, stats *runStats) (*runReport, error) {
+	if format != reportJSON && format != reportCSV {
+		return nil, errors.New("report format " + format + " not supported, use json/csv")
+	}
+	file, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &runReport{
+		file:   file,
+		format: format,
+		start:  time.Now(),
+		stats:  stats,
+	}
+	if format == reportCSV {
+		report.csv = csv.NewWriter(file)
+		err = report.csv.Write(reportHeader)
+	} else {
+		_, err = io.WriteString(file, "{\"files\":[")
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return report, nil
+}
+
+// add writes the entry of a file, it is safe for concurrent use and a no-op
+// on a nil report
+func (report *runReport) add(entry *fileReport) error {
+	if report == nil {
+		return nil
+	}
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	report.totals.Files++
+	if entry.Error != "" {
+		report.totals.Failed++
+	}
+	report.totals.PointsRead += entry.PointsRead
+	report.totals.PointsSent += entry.PointsSent
+
+	if report.format == reportCSV {
+		return report.csv.Write([]string{
+			entry.Path,
+			entry.Metric,
+			strconv.FormatInt(entry.PointsRead, 10),
+			strconv.FormatInt(entry.PointsSent, 10),
+			strconv.FormatInt(entry.FirstTs, 10),
+			strconv.FormatInt(entry.LastTs, 10),
+			strconv.FormatFloat(entry.Duration, 'f', 3, 64),
+			entry.Error,
+		})
+	}
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if report.entries > 0 {
+		encoded = append([]byte{','}, encoded...)
+	}
+	report.entries++
+	_, err = report.file.Write(append(encoded, '\n'))
+	return err
+}
+
+// Close writes the totals and closes the report. In CSV the totals are a
+// last row with the path TOTAL, the failed and skipped counts in the error
+// column.
+func (report *runReport) Close() error {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	report.totals.Skipped = report.stats.skipped.Load()
+	report.totals.Duration = time.Since(report.start).Seconds()
+
+	var err error
+	if report.format == reportCSV {
+		totals := report.totals
+		err = report.csv.Write([]string{
+			"TOTAL",
+			strconv.FormatInt(totals.Files, 10) + " files",
+			strconv.FormatInt(totals.PointsRead, 10),
+			strconv.FormatInt(totals.PointsSent, 10),
+			"",
+			"",
+			strconv.FormatFloat(totals.Duration, 'f', 3, 64),
+			strconv.FormatInt(totals.Failed, 10) + " failed, " + strconv.FormatInt(totals.Skipped, 10) + " skipped",
+		})
+		report.csv.Flush()
+		err = errors.Join(err, report.csv.Error())
+	} else {
+		var encoded []byte
+		encoded, err = json.Marshal(report.totals)
+		if err == nil {
+			_, err = report.file.Write(append(append([]byte("],\"totals\":"), encoded...), "}\n"...))
+		}
+	}
+	return errors.Join(err, report.file.Close())
+}
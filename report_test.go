@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFileReportAddPoint(t *testing.T) {
+	t.Parallel()
+
+	report := &fileReport{}
+	for _, ts := range []int64{1700000060, 1700000000, 1700000120} {
+		report.addPoint(ts)
+	}
+	if report.PointsRead != 3 || report.FirstTs != 1700000000 || report.LastTs != 1700000120 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+// writeTestReport writes a report of the entries and returns its content
+func writeTestReport(t *testing.T, format string, stats *runStats, entries []fileReport) []byte {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "report."+format)
+	report, err := newRunReport(path, format, stats)
+	if err != nil {
+		t.Fatalf("newRunReport() error = %v", err)
+	}
+	for i := range entries {
+		if err := report.add(&entries[i]); err != nil {
+			t.Fatalf("add() error = %v", err)
+		}
+	}
+	if err := report.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the report: %v", err)
+	}
+	return content
+}
+
+func TestRunReportJSON(t *testing.T) {
+	t.Parallel()
+
+	stats := newRunStats(1)
+	stats.fileSkipped()
+	entries := []fileReport{
+		{Path: "/a.wsp", Metric: "a", PointsRead: 10, PointsSent: 10, FirstTs: 1700000000, LastTs: 1700000540, Duration: 0.5},
+		{Path: "/b.wsp", Metric: "b", PointsRead: 4, Error: "broken pipe"},
+	}
+	content := writeTestReport(t, reportJSON, stats, entries)
+
+	var decoded struct {
+		Files  []fileReport `json:"files"`
+		Totals reportTotals `json:"totals"`
+	}
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		t.Fatalf("invalid JSON report %q: %v", content, err)
+	}
+	if !slices.Equal(decoded.Files, entries) {
+		t.Errorf("unexpected file entries %+v", decoded.Files)
+	}
+	totals := decoded.Totals
+	if totals.Files != 2 || totals.Failed != 1 || totals.Skipped != 1 || totals.PointsRead != 14 || totals.PointsSent != 10 {
+		t.Errorf("unexpected totals %+v", totals)
+	}
+}
+
+func TestRunReportJSONEmpty(t *testing.T) {
+	t.Parallel()
+
+	if content := writeTestReport(t, reportJSON, newRunStats(1), nil); !json.Valid(content) {
+		t.Errorf("invalid JSON report %q", content)
+	}
+}
+
+func TestRunReportCSV(t *testing.T) {
+	t.Parallel()
+
+	content := writeTestReport(t, reportCSV, newRunStats(1), []fileReport{
+		{Path: "/a.wsp", Metric: "a", PointsRead: 10, PointsSent: 8, FirstTs: 1700000000, LastTs: 1700000540, Duration: 0.25, Error: "broken, pipe"},
+	})
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV report: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected header, entry and totals, got %q", records)
+	}
+	want := []string{"/a.wsp", "a", "10", "8", "1700000000", "1700000540", "0.250", "broken, pipe"}
+	for i := range want {
+		if records[1][i] != want[i] {
+			t.Errorf("column %s = %q, want %q", reportHeader[i], records[1][i], want[i])
+		}
+	}
+	if records[2][0] != "TOTAL" || records[2][1] != "1 files" || records[2][7] != "1 failed, 0 skipped" {
+		t.Errorf("unexpected totals %q", records[2])
+	}
+}
+
+func TestNewRunReportFormat(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newRunReport(filepath.Join(t.TempDir(), "report.xml"), "xml", newRunStats(1)); err == nil {
+		t.Error("expected error for an unknown report format")
+	}
+}
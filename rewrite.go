@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// rewriteRule replaces every match of pattern in a metric name
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// metricRewriter renames the metrics after convertFilename, applying an
+// ordered list of rules, the first matching tag template and then the prefix
+type metricRewriter struct {
+	rules     []rewriteRule
+	templates []*pathTemplate
+	prefix    string
+}
+
+// pythonGroup matches the group references of a Python re.sub replacement
+var pythonGroup = regexp.MustCompile(`\\(?:(\d+)|g<(\w+)>)`)
+
+// convertReplacement converts a Python re.sub replacement, as used by carbon,
+// into the regexp.Expand syntax
+func convertReplacement(replacement string) string {
+	replacement = strings.ReplaceAll(replacement, "$", "$$")
+	return pythonGroup.ReplaceAllString(replacement, "$${$1$2}")
+}
+
+// parseRewriteRule parses a rule in the carbon "pattern = replacement" form
+func parseRewriteRule(rule string) (rewriteRule, error) {
+	pattern, replacement, found := strings.Cut(rule, "=")
+	if !found {
+		return rewriteRule{}, errors.New("invalid rewrite rule, expected pattern = replacement: " + rule)
+	}
+	expr, err := regexp.Compile(strings.TrimSpace(pattern))
+	if err != nil {
+		return rewriteRule{}, err
+	}
+	return rewriteRule{
+		pattern:     expr,
+		replacement: convertReplacement(strings.TrimSpace(replacement)),
+	}, nil
+}
+
+// newMetricRewriter parses the rules, in order, and the prefix
+func newMetricRewriter(rules []string, prefix string) (*metricRewriter, error) {
+	rewriter := &metricRewriter{prefix: prefix}
+	for _, rule := range rules {
+		parsed, err := parseRewriteRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		rewriter.rules = append(rewriter.rules, parsed)
+	}
+	return rewriter, nil
+}
+
+// load appends the rules of a carbon rewrite-rules.conf file. The [pre] and
+// [post] sections are applied in the order they appear, comments start with #.
+func (rewriter *metricRewriter) load(path string) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section := line[1 : len(line)-1]
+			if section != "pre" && section != "post" {
+				return errors.New("unknown section in rewrite rules: " + line)
+			}
+			continue
+		}
+		rule, err := parseRewriteRule(line)
+		if err != nil {
+			return err
+		}
+		rewriter.rules = append(rewriter.rules, rule)
+	}
+	return scanner.Err()
+}
+
+// addTemplate parses a tag template, templates are tried in the order they
+// are added
+func (rewriter *metricRewriter) addTemplate(line string) error {
+	template, err := parsePathTemplate(line)
+	if err != nil {
+		return err
+	}
+	rewriter.templates = append(rewriter.templates, template)
+	return nil
+}
+
+// loadTemplates adds the tag templates of a file, one per line
+func (rewriter *metricRewriter) loadTemplates(path string) error {
+	templates, err := loadPathTemplates(path)
+	if err != nil {
+		return err
+	}
+	rewriter.templates = append(rewriter.templates, templates...)
+	return nil
+}
+
+// taggedName builds a Graphite tagged series name, name;tag1=value1;..., from
+// the roles of a template. The "name" role is the series name and the tags
+// are sorted by key, as carbon does. The metric name is kept unchanged when
+// the template leaves no series name.
+func taggedName(metricName string, roles map[string]string) string {
+	name := roles["name"]
+	if name == "" {
+		return metricName
+	}
+
+	keys := make([]string, 0, len(roles))
+	for key := range roles {
+		if key != "name" && roles[key] != "" {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var tagged strings.Builder
+	tagged.WriteString(name)
+	for _, key := range keys {
+		tagged.WriteString(";" + key + "=" + strings.ReplaceAll(roles[key], ";", "_"))
+	}
+	return tagged.String()
+}
+
+// rewrite returns the new name of a metric. The tag templates are not applied
+// to the series that are already tagged.
+func (rewriter *metricRewriter) rewrite(metricName string) string {
+	for _, rule := range rewriter.rules {
+		metricName = rule.pattern.ReplaceAllString(metricName, rule.replacement)
+	}
+	if !strings.Contains(metricName, ";") {
+		if template := matchTemplate(rewriter.templates, metricName); template != nil {
+			metricName = taggedName(metricName, template.apply(metricName))
+		}
+	}
+	if rewriter.prefix != "" {
+		metricName = rewriter.prefix + "." + metricName
+	}
+	return metricName
+}
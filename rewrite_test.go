@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertReplacement(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		`\1.\2`:         `${1}.${2}`,
+		`\g<host>.load`: `${host}.load`,
+		`cost.$1`:       `cost.$$1`,
+		`plain`:         `plain`,
+	}
+	for replacement, want := range tests {
+		if got := convertReplacement(replacement); got != want {
+			t.Errorf("convertReplacement(%q) = %q, want %q", replacement, got, want)
+		}
+	}
+}
+
+func TestMetricRewriter(t *testing.T) {
+	t.Parallel()
+
+	rewriter, err := newMetricRewriter([]string{
+		`^collectd\.([^.]+)\.(.*)$ = servers.\1.\2`,
+		`_ = -`,
+		`\.(?P<plugin>cpu)-(\d+)\. = .\g<plugin>.\2.`,
+	}, "new")
+	if err != nil {
+		t.Fatalf("newMetricRewriter() error = %v", err)
+	}
+
+	tests := map[string]string{
+		"collectd.web_01.cpu-0.cpu-user": "new.servers.web-01.cpu.0.cpu-user",
+		"stats.a_b_c":                    "new.stats.a-b-c",
+	}
+	for name, want := range tests {
+		if got := rewriter.rewrite(name); got != want {
+			t.Errorf("rewrite(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, invalid := range []string{"no replacement", "( = x"} {
+		if _, err := newMetricRewriter([]string{invalid}, ""); err == nil {
+			t.Errorf("expected error for rule %q", invalid)
+		}
+	}
+
+	rewriter, _ = newMetricRewriter(nil, "")
+	if got := rewriter.rewrite("a.b"); got != "a.b" {
+		t.Errorf("expected name to be unchanged without rules, got %q", got)
+	}
+}
+
+func TestMetricRewriterLoad(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "rewrite-rules.conf")
+	content := `# carbon rewrite rules
+[pre]
+^collectd\.([^.]+)\. = servers.\1.
+
+[post]
+\.load$ = .loadavg
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write rewrite rules: %v", err)
+	}
+
+	rewriter, _ := newMetricRewriter(nil, "")
+	if err := rewriter.load(path); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if got := rewriter.rewrite("collectd.web01.load"); got != "servers.web01.loadavg" {
+		t.Errorf("rewrite() = %q, want servers.web01.loadavg", got)
+	}
+
+	if err := os.WriteFile(path, []byte("[middle]\na = b\n"), 0600); err != nil {
+		t.Fatalf("failed to write rewrite rules: %v", err)
+	}
+	if err := rewriter.load(path); err == nil {
+		t.Error("expected error for an unknown section")
+	}
+}
+
+func TestMetricRewriterTemplates(t *testing.T) {
+	t.Parallel()
+
+	rewriter, _ := newMetricRewriter([]string{`^collectd\. = servers.`}, "new")
+	if err := rewriter.addTemplate("servers.* .host.name* dc=eu"); err != nil {
+		t.Fatalf("addTemplate() error = %v", err)
+	}
+	if err := rewriter.addTemplate("stats.* .type"); err != nil {
+		t.Fatalf("addTemplate() error = %v", err)
+	}
+
+	tests := map[string]string{
+		"collectd.web01.cpu.user":  "new.cpu.user;dc=eu;host=web01",
+		"stats.counters.foo.count": "new.stats.counters.foo.count",
+		"other.metric":             "new.other.metric",
+	}
+	for name, want := range tests {
+		if got := rewriter.rewrite(name); got != want {
+			t.Errorf("rewrite(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "templates")
+	if err := os.WriteFile(path, []byte("# templates\n\nname.region\n"), 0600); err != nil {
+		t.Fatalf("failed to write templates: %v", err)
+	}
+	rewriter, _ = newMetricRewriter(nil, "")
+	if err := rewriter.loadTemplates(path); err != nil {
+		t.Fatalf("loadTemplates() error = %v", err)
+	}
+	if got := rewriter.rewrite("load.eu"); got != "load;region=eu" {
+		t.Errorf("rewrite() = %q, want load;region=eu", got)
+	}
+}
+
+func TestTaggedName(t *testing.T) {
+	t.Parallel()
+
+	roles := map[string]string{"name": "cpu.user", "host": "web01", "dc": "a;b", "empty": ""}
+	if got := taggedName("servers.web01.cpu.user", roles); got != "cpu.user;dc=a_b;host=web01" {
+		t.Errorf("taggedName() = %q", got)
+	}
+	if got := taggedName("servers.web01", map[string]string{"host": "web01"}); got != "servers.web01" {
+		t.Errorf("expected the metric name without a series name, got %q", got)
+	}
+}
+
+func TestMetricRewriterTaggedSeries(t *testing.T) {
+	t.Parallel()
+
+	rewriter, _ := newMetricRewriter(nil, "")
+	if err := rewriter.addTemplate(".host.name*"); err != nil {
+		t.Fatalf("addTemplate() error = %v", err)
+	}
+	if got := rewriter.rewrite("cpu.user;host=web01"); got != "cpu.user;host=web01" {
+		t.Errorf("expected tagged series to be unchanged, got %q", got)
+	}
+}
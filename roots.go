@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Policies merging the points of a metric found in several base directories
+const (
+	mergeNewest  = "newest"
+	mergeNonNull = "nonnull"
+	mergeAverage = "average"
+)
+
+// sourceRoots are the base directories the whisper files are read from, such
+// as the roots of several carbon-cache instances. Files at the same path
+// relative to their root hold the same metric: they are sent once, with their
+// points merged by policy.
+type sourceRoots struct {
+	directories []string
+	policy      string
+}
+
+// newSourceRoots parses a comma separated list of base directories
+func newSourceRoots(directories string, policy string) (*sourceRoots, error) {
+	if policy != mergeNewest && policy != mergeNonNull && policy != mergeAverage {
+		return nil, errors.New("merge policy " + policy + " not supported, use newest/nonnull/average")
+	}
+	roots := &sourceRoots{policy: policy}
+	for directory := range strings.SplitSeq(directories, ",") {
+		if directory = strings.TrimSpace(directory); directory != "" {
+			roots.directories = append(roots.directories, filepath.Clean(directory))
+		}
+	}
+	if len(roots.directories) == 0 {
+		return nil, errors.New("at least one base directory is required")
+	}
+	return roots, nil
+}
+
+// relative returns the root holding path and the path relative to it. With
+// nested roots the deepest one is used.
+func (roots *sourceRoots) relative(path string) (string, string, bool) {
+	root, relativePath, found := "", "", false
+	for _, directory := range roots.directories {
+		rel, err := filepath.Rel(directory, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if !found || len(directory) > len(root) {
+			root, relativePath, found = directory, rel, true
+		}
+	}
+	return root, relativePath, found
+}
+
+// base returns the base directory the metric name of a whisper file is
+// computed from
+func (roots *sourceRoots) base(filename string) string {
+	if root, _, found := roots.relative(filename); found {
+		return root
+	}
+	return roots.directories[0]
+}
+
+// sources returns the whisper files holding the same metric as filename, in
+// the order of the roots. With the newest policy only the most recently
+// modified one is returned.
+func (roots *sourceRoots) sources(filename string) ([]string, error) {
+	_, relativePath, found := roots.relative(filename)
+	if len(roots.directories) == 1 || !found {
+		return []string{filename}, nil
+	}
+
+	var files []string
+	var newest string
+	var newestInfo os.FileInfo
+	for _, directory := range roots.directories {
+		path := filepath.Join(directory, relativePath)
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, path)
+		if newestInfo == nil || info.ModTime().After(newestInfo.ModTime()) {
+			newest, newestInfo = path, info
+		}
+	}
+	if len(files) == 0 {
+		return []string{filename}, nil
+	}
+	if roots.policy == mergeNewest {
+		return []string{newest}, nil
+	}
+	return files, nil
+}
+
+// scanDirectories returns directory, and with several roots the directory at
+// the same relative path in every other root
+func (roots *sourceRoots) scanDirectories(directory string) ([]string, error) {
+	if len(roots.directories) == 1 {
+		return []string{directory}, nil
+	}
+	_, relativePath, found := roots.relative(filepath.Clean(directory))
+	if !found {
+		return nil, errors.New("directory " + directory + " is not below any base directory")
+	}
+	directories := make([]string, 0, len(roots.directories))
+	for _, root := range roots.directories {
+		directories = append(directories, filepath.Join(root, relativePath))
+	}
+	return directories, nil
+}
+
+// find sends every whisper file below directory to ch, in every root. A
+// metric held by several roots is only sent once, with the path of the
+// first root holding it.
+func (roots *sourceRoots) find(ctx context.Context, ch chan<- string, directory string) error {
+	directories, err := roots.scanDirectories(directory)
+	if err != nil {
+		return err
+	}
+	if len(directories) == 1 {
+		return findWhisperFiles(ctx, ch, directories[0])
+	}
+
+	for i, scanned := range directories {
+		if err := filepath.Walk(scanned, roots.visitor(ctx, ch, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitor returns the function walking the root at index, sending the whisper
+// files of the metrics no previous root holds to ch
+func (roots *sourceRoots) visitor(ctx context.Context, ch chan<- string, index int) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if info == nil || info.IsDir() || !strings.HasSuffix(path, ".wsp") {
+			return nil
+		}
+		relativePath, err := filepath.Rel(roots.directories[index], path)
+		if err != nil {
+			return err
+		}
+		for _, previous := range roots.directories[:index] {
+			if _, err := os.Stat(filepath.Join(previous, relativePath)); err == nil {
+				return nil
+			}
+		}
+		select {
+		case ch <- path:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	}
+}
+
+// metricSources are the whisper files of every root holding a metric,
+// opened to read its points
+type metricSources struct {
+	sources []*whisperSource
+	policy  string
+}
+
+// open opens the whisper files holding the metric of filename, between
+// fromTs and toTs. They stay open until Close.
+func (roots *sourceRoots) open(filename string, fromTs int, toTs int, selection archiveSelection) (*metricSources, error) {
+	files, err := roots.sources(filename)
+	if err != nil {
+		return nil, err
+	}
+	metric := &metricSources{sources: make([]*whisperSource, 0, len(files)), policy: roots.policy}
+	for _, file := range files {
+		source, err := openWhisperSource(file, fromTs, toTs, selection)
+		if err != nil {
+			metric.Close()
+			return nil, err
+		}
+		metric.sources = append(metric.sources, source)
+	}
+	return metric, nil
+}
+
+// points returns the points of the metric in timestamp order, merged from
+// every file. They are read from the files while they are iterated, err
+// returns the first read error once the iteration ends.
+func (metric *metricSources) points() iter.Seq[seriesPoint] {
+	sources := make([]iter.Seq[seriesPoint], 0, len(metric.sources))
+	for _, source := range metric.sources {
+		sources = append(sources, mergeSeries(source.series))
+	}
+	if len(sources) == 1 {
+		return sources[0]
+	}
+	return mergeSources(sources, metric.policy)
+}
+
+// skipSent raises the lower bound of every series to the first timestamp of
+// its metric still to send, so that the slots already sent are not read again
+func (metric *metricSources) skipSent(resumeTs func(suffix string) int64) {
+	for _, source := range metric.sources {
+		for i := range source.series {
+			series := &source.series[i]
+			series.fromTs = max(series.fromTs, int(resumeTs(series.suffix)))
+		}
+	}
+}
+
+// err returns the first error met while reading the points
+func (metric *metricSources) err() error {
+	for _, source := range metric.sources {
+		if err := source.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the whisper files
+func (metric *metricSources) Close() {
+	for _, source := range metric.sources {
+		source.Close()
+	}
+}
+
+// mergeSources merges the points of the same metric read from several files,
+// each one in timestamp order. The points sharing a timestamp and a suffix
+// become one point: the first non-null value in the order of the sources
+// with the nonnull policy, the average of the non-null values with the
+// average policy.
+func mergeSources(sources []iter.Seq[seriesPoint], policy string) iter.Seq[seriesPoint] {
+	return func(yield func(seriesPoint) bool) {
+		pulled := &pulledSources{
+			nexts: make([]func() (seriesPoint, bool), 0, len(sources)),
+			heads: make([]seriesPoint, 0, len(sources)),
+		}
+		for _, source := range sources {
+			next, stop := iter.Pull(source)
+			defer stop()
+			if point, ok := next(); ok {
+				pulled.nexts = append(pulled.nexts, next)
+				pulled.heads = append(pulled.heads, point)
+			}
+		}
+
+		var group []seriesPoint
+		for len(pulled.heads) > 0 {
+			group = pulled.oldest(group[:0])
+			for i, point := range group {
+				if slices.ContainsFunc(group[:i], func(previous seriesPoint) bool { return previous.suffix == point.suffix }) {
+					continue
+				}
+				point.value = mergeValues(group[i:], point.suffix, policy)
+				if !yield(point) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// pulledSources are the sources being merged, with the next point of each
+type pulledSources struct {
+	nexts []func() (seriesPoint, bool)
+	heads []seriesPoint
+}
+
+// oldest appends to group every point of the oldest timestamp, in the order
+// of the sources, and drops the exhausted sources
+func (pulled *pulledSources) oldest(group []seriesPoint) []seriesPoint {
+	oldest := pulled.heads[0].time
+	for _, head := range pulled.heads {
+		oldest = min(oldest, head.time)
+	}
+
+	live := 0
+	for i := range pulled.heads {
+		head, ok := pulled.heads[i], true
+		for ok && head.time == oldest {
+			group = append(group, head)
+			head, ok = pulled.nexts[i]()
+		}
+		if ok {
+			pulled.nexts[live], pulled.heads[live] = pulled.nexts[i], head
+			live++
+		}
+	}
+	pulled.nexts, pulled.heads = pulled.nexts[:live], pulled.heads[:live]
+	return group
+}
+
+// mergeValues merges the values of the points with the suffix
+func mergeValues(points []seriesPoint, suffix string, policy string) float64 {
+	sum, count := 0.0, 0
+	for _, point := range points {
+		if point.suffix != suffix || math.IsNaN(point.value) {
+			continue
+		}
+		if policy != mergeAverage {
+			return point.value
+		}
+		sum += point.value
+		count++
+	}
+	if count == 0 {
+		return math.NaN()
+	}
+	return sum / float64(count)
+}
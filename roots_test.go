@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"iter"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// testRoots returns the roots of the given base directories, merged with the
+// nonnull policy
+func testRoots(directories ...string) *sourceRoots {
+	return &sourceRoots{directories: directories, policy: mergeNonNull}
+}
+
+// recordingSender is a Sender keeping every metric it is sent, and the size of
+// every batch
+type recordingSender struct {
+	metrics []Metric
+	batches []int
+}
+
+func (sender *recordingSender) Connect() error    { return nil }
+func (sender *recordingSender) Disconnect() error { return nil }
+func (sender *recordingSender) SendMetrics(metrics []Metric) error {
+	sender.metrics = append(sender.metrics, metrics...)
+	sender.batches = append(sender.batches, len(metrics))
+	return nil
+}
+
+func TestNewSourceRoots(t *testing.T) {
+	t.Parallel()
+
+	roots, err := newSourceRoots("/var/lib/carbon/a/, /var/lib/carbon/b,,", mergeAverage)
+	if err != nil {
+		t.Fatalf("newSourceRoots() error = %v", err)
+	}
+	if !slices.Equal(roots.directories, []string{"/var/lib/carbon/a", "/var/lib/carbon/b"}) || roots.policy != mergeAverage {
+		t.Errorf("unexpected roots %+v", roots)
+	}
+
+	if _, err := newSourceRoots("/var/lib/carbon/a", "first"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+	if _, err := newSourceRoots(" , ", mergeNewest); err == nil {
+		t.Error("expected an error without base directories")
+	}
+}
+
+func TestSourceRootsDirectories(t *testing.T) {
+	t.Parallel()
+
+	roots := testRoots("/carbon/a", "/carbon/b", "/carbon/a/nested")
+	tests := []struct {
+		path     string
+		base     string
+		relative string
+	}{
+		{"/carbon/a/servers/cpu.wsp", "/carbon/a", "servers/cpu.wsp"},
+		{"/carbon/b/servers/cpu.wsp", "/carbon/b", "servers/cpu.wsp"},
+		{"/carbon/a/nested/cpu.wsp", "/carbon/a/nested", "cpu.wsp"},
+		{"/carbon/c/cpu.wsp", "/carbon/a", ""},
+	}
+	for _, tt := range tests {
+		if base := roots.base(tt.path); base != tt.base {
+			t.Errorf("base(%q) = %q, want %q", tt.path, base, tt.base)
+		}
+		if _, relative, _ := roots.relative(tt.path); relative != tt.relative {
+			t.Errorf("relative(%q) = %q, want %q", tt.path, relative, tt.relative)
+		}
+	}
+
+	directories, err := testRoots("/carbon/a", "/carbon/b").scanDirectories("/carbon/b/collectd")
+	if err != nil {
+		t.Fatalf("scanDirectories() error = %v", err)
+	}
+	if !slices.Equal(directories, []string{"/carbon/a/collectd", "/carbon/b/collectd"}) {
+		t.Errorf("unexpected directories %v", directories)
+	}
+	if _, err := testRoots("/carbon/a", "/carbon/b").scanDirectories("/srv/collectd"); err == nil {
+		t.Error("expected an error for a directory outside of the roots")
+	}
+	if directories, err := testRoots("/carbon/a").scanDirectories("/srv/collectd"); err != nil || !slices.Equal(directories, []string{"/srv/collectd"}) {
+		t.Errorf("expected a single root to scan the directory as is, got %v, %v", directories, err)
+	}
+}
+
+func TestSourceRootsFind(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	a, b, c := filepath.Join(base, "a"), filepath.Join(base, "b"), filepath.Join(base, "c")
+	createTestFiles(t, base, []string{
+		filepath.Join(a, "servers", "cpu.wsp"),
+		filepath.Join(b, "servers", "cpu.wsp"),
+		filepath.Join(b, "servers", "memory.wsp"),
+		filepath.Join(c, "servers", "memory.wsp"),
+		filepath.Join(c, "servers", "disk.wsp"),
+		filepath.Join(c, "other", "load.wsp"),
+	})
+
+	roots := testRoots(a, b, c)
+	ch := make(chan string, 10)
+	if err := roots.find(context.Background(), ch, filepath.Join(b, "servers")); err != nil {
+		t.Fatalf("find() error = %v", err)
+	}
+	close(ch)
+	var found []string
+	for path := range ch {
+		found = append(found, path)
+	}
+	want := []string{
+		filepath.Join(a, "servers", "cpu.wsp"),
+		filepath.Join(b, "servers", "memory.wsp"),
+		filepath.Join(c, "servers", "disk.wsp"),
+	}
+	if !slices.Equal(found, want) {
+		t.Errorf("find() = %v, want %v", found, want)
+	}
+
+	count, err := countWhisperFiles(roots, a)
+	if err != nil || count != 4 {
+		t.Errorf("countWhisperFiles() = %d, %v, want 4", count, err)
+	}
+}
+
+func TestSourceRootsSources(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	a, b, c := filepath.Join(base, "a"), filepath.Join(base, "b"), filepath.Join(base, "c")
+	createTestFiles(t, base, []string{
+		filepath.Join(a, "cpu.wsp"),
+		filepath.Join(c, "cpu.wsp"),
+	})
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(c, "cpu.wsp"), old, old); err != nil {
+		t.Fatalf("failed to change the modification time: %v", err)
+	}
+
+	roots := testRoots(a, b, c)
+	sources, err := roots.sources(filepath.Join(a, "cpu.wsp"))
+	if err != nil || !slices.Equal(sources, []string{filepath.Join(a, "cpu.wsp"), filepath.Join(c, "cpu.wsp")}) {
+		t.Errorf("sources() = %v, %v", sources, err)
+	}
+
+	roots.policy = mergeNewest
+	sources, err = roots.sources(filepath.Join(a, "cpu.wsp"))
+	if err != nil || !slices.Equal(sources, []string{filepath.Join(a, "cpu.wsp")}) {
+		t.Errorf("sources() with the newest policy = %v, %v", sources, err)
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	t.Parallel()
+
+	nan := math.NaN()
+	sources := []iter.Seq[seriesPoint]{
+		slices.Values([]seriesPoint{
+			{time: 60, value: 1},
+			{time: 120, value: nan},
+			{time: 180, value: 3},
+		}),
+		slices.Values([]seriesPoint{
+			{time: 0, value: 10},
+			{time: 60, value: 11},
+			{time: 120, value: 12},
+			{time: 120, suffix: ".1h", value: 13},
+			{time: 180, value: nan},
+		}),
+		slices.Values([]seriesPoint{
+			{time: 120, value: 22},
+		}),
+	}
+
+	tests := []struct {
+		policy string
+		want   []seriesPoint
+	}{
+		{mergeNonNull, []seriesPoint{
+			{time: 0, value: 10},
+			{time: 60, value: 1},
+			{time: 120, value: 12},
+			{time: 120, suffix: ".1h", value: 13},
+			{time: 180, value: 3},
+		}},
+		{mergeAverage, []seriesPoint{
+			{time: 0, value: 10},
+			{time: 60, value: 6},
+			{time: 120, value: 17},
+			{time: 120, suffix: ".1h", value: 13},
+			{time: 180, value: 3},
+		}},
+	}
+	for _, tt := range tests {
+		got := slices.Collect(mergeSources(sources, tt.policy))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("mergeSources(%s) = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestSendWhisperDataRoots(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	first := now - now%60 - 180
+	base := t.TempDir()
+	a, b := filepath.Join(base, "a"), filepath.Join(base, "b")
+	createWhisperFile(t, filepath.Join(a, "foo", "bar.wsp"), "1m:1h", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 1},
+		{Time: first + 120, Value: 3},
+	})
+	createWhisperFile(t, filepath.Join(b, "foo", "bar.wsp"), "1m:1h", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 5},
+		{Time: first + 60, Value: 2},
+	})
+
+	tests := []struct {
+		policy string
+		values []string
+	}{
+		{mergeNonNull, []string{"1", "2", "3"}},
+		{mergeAverage, []string{"3", "2", "3"}},
+	}
+	for _, tt := range tests {
+		j, err := newJournal("", false, false)
+		if err != nil {
+			t.Fatalf("newJournal() error = %v", err)
+		}
+		roots := &sourceRoots{directories: []string{a, b}, policy: tt.policy}
+		sender := &recordingSender{}
+		selection := archiveSelection{mode: archivesFetch, index: -1}
+		report := &fileReport{}
+		if err := sendWhisperData(filepath.Join(a, "foo", "bar.wsp"), roots, sender, 0, 2147483647, selection, batchSize{points: 10000}, 1, newRateLimiter(0, 0, time.Second), j, &metricRewriter{}, report); err != nil {
+			t.Fatalf("sendWhisperData() error = %v", err)
+		}
+
+		values := make([]string, 0, len(sender.metrics))
+		for _, metric := range sender.metrics {
+			if metric.Name != "foo.bar" {
+				t.Errorf("unexpected metric name %q", metric.Name)
+			}
+			values = append(values, metric.Value)
+		}
+		if !slices.Equal(values, tt.values) || report.PointsSent != 3 {
+			t.Errorf("%s: expected %v, got %v", tt.policy, tt.values, values)
+		}
+	}
+}
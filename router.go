@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/md5" // #nosec G501 -- carbon uses md5 to place nodes on the ring, not for security
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Hash types of the carbon consistent hashing ring (ROUTER_HASH_TYPE)
+const (
+	hashTypeCarbon = "carbon_ch"
+	hashTypeFNV1a  = "fnv1a_ch"
+)
+
+// ringReplicaCount is the number of positions of each node on the ring, as
+// hardcoded in carbon
+const ringReplicaCount = 100
+
+// carbonDestination is a carbon instance, as listed in the DESTINATIONS
+// setting of carbon-relay
+type carbonDestination struct {
+	Server   string
+	Port     int
+	Instance string
+}
+
+// key returns the name of the destination on the ring. Carbon uses the
+// Python representation of the (server, instance) tuple.
+func (destination carbonDestination) key() string {
+	instance := destination.instance()
+	if destination.Instance != "" {
+		instance = "'" + instance + "'"
+	}
+	return "('" + destination.Server + "', " + instance + ")"
+}
+
+// instance returns the instance name as formatted by Python, None when the
+// destination has none
+func (destination carbonDestination) instance() string {
+	if destination.Instance == "" {
+		return "None"
+	}
+	return destination.Instance
+}
+
+// parseDestinations parses a comma separated list of carbon destinations in
+// the server:port[:instance] form, IPv6 servers are enclosed in brackets
+func parseDestinations(destinations string) ([]carbonDestination, error) {
+	parsed := make([]carbonDestination, 0)
+	for _, destination := range strings.Split(destinations, ",") {
+		destination = strings.TrimSpace(destination)
+		server := ""
+		rest := destination
+		if strings.HasPrefix(destination, "[") {
+			end := strings.Index(destination, "]")
+			if end < 0 {
+				return nil, errors.New("invalid destination " + destination)
+			}
+			server = destination[1:end]
+			rest = strings.TrimPrefix(destination[end+1:], ":")
+		} else {
+			server, rest, _ = strings.Cut(destination, ":")
+		}
+
+		parts := strings.Split(rest, ":")
+		if server == "" || len(parts) > 2 {
+			return nil, errors.New("invalid destination " + destination)
+		}
+		port, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in destination %s: %v", destination, err)
+		}
+		instance := ""
+		if len(parts) == 2 {
+			instance = parts[1]
+		}
+		parsed = append(parsed, carbonDestination{Server: server, Port: port, Instance: instance})
+	}
+	return parsed, nil
+}
+
+// ringEntry is a position of a node on the ring
+type ringEntry struct {
+	position int
+	node     int
+}
+
+// consistentHashRing is a port of the carbon ConsistentHashRing, so that
+// metrics are routed to the same instances as a carbon-relay would do
+type consistentHashRing struct {
+	hashType string
+	ring     []ringEntry
+	nodes    []carbonDestination
+}
+
+func newConsistentHashRing(hashType string) (*consistentHashRing, error) {
+	if hashType != hashTypeCarbon && hashType != hashTypeFNV1a {
+		return nil, errors.New("hash type " + hashType + " not supported, use " + hashTypeCarbon + "/" + hashTypeFNV1a)
+	}
+	return &consistentHashRing{hashType: hashType}, nil
+}
+
+// position computes the position of a key on the ring
+func (ring *consistentHashRing) position(key string) int {
+	if ring.hashType == hashTypeFNV1a {
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		bigHash := hash.Sum32()
+		return int((bigHash >> 16) ^ (bigHash & 0xffff))
+	}
+
+	sum := md5.Sum([]byte(key)) // #nosec G401 -- see import
+	position, _ := strconv.ParseInt(hex.EncodeToString(sum[:2]), 16, 32)
+	return int(position)
+}
+
+// addNode places the replicas of a destination on the ring, moving them to
+// the next free position on collisions
+func (ring *consistentHashRing) addNode(destination carbonDestination) error {
+	for _, node := range ring.nodes {
+		if node.Server == destination.Server && node.Instance == destination.Instance {
+			return fmt.Errorf("destination instance (%s, %s) already configured", destination.Server, destination.Instance)
+		}
+	}
+	ring.nodes = append(ring.nodes, destination)
+	node := len(ring.nodes) - 1
+
+	for i := 0; i < ringReplicaCount; i++ {
+		replicaKey := fmt.Sprintf("%s:%d", destination.key(), i)
+		if ring.hashType == hashTypeFNV1a {
+			replicaKey = fmt.Sprintf("%d-%s", i, destination.instance())
+		}
+		position := ring.position(replicaKey)
+		for slices.ContainsFunc(ring.ring, func(entry ringEntry) bool { return entry.position == position }) {
+			position++
+		}
+
+		index := sort.Search(len(ring.ring), func(j int) bool {
+			return ring.ring[j].position >= position
+		})
+		ring.ring = slices.Insert(ring.ring, index, ringEntry{position: position, node: node})
+	}
+	return nil
+}
+
+// getNodes returns the distinct nodes in ring order starting from the position
+// of key, the first one being the primary destination
+func (ring *consistentHashRing) getNodes(key string) []int {
+	if len(ring.nodes) <= 1 {
+		return make([]int, len(ring.nodes))
+	}
+
+	position := ring.position(key)
+	index := sort.Search(len(ring.ring), func(j int) bool {
+		return ring.ring[j].position >= position
+	}) % len(ring.ring)
+	lastIndex := (index - 1 + len(ring.ring)) % len(ring.ring)
+
+	nodes := make([]int, 0, len(ring.nodes))
+	for len(nodes) < len(ring.nodes) && index != lastIndex {
+		node := ring.ring[index].node
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+		index = (index + 1) % len(ring.ring)
+	}
+	return nodes
+}
+
+// CarbonRouter sends each metric to the carbon instances that a carbon-relay
+// with the consistent-hashing method would pick, with one Graphite connection
+// per destination
+type CarbonRouter struct {
+	ring              *consistentHashRing
+	nodes             []*Graphite
+	replicationFactor int
+	diverseReplicas   bool
+}
+
+// NewCarbonRouter connects to every destination with the given protocol and
+// returns the router. replicationFactor and diverseReplicas match the carbon
+// REPLICATION_FACTOR and DIVERSE_REPLICAS settings.
+func NewCarbonRouter(
+	destinations []carbonDestination,
+	hashType string,
+	replicationFactor int,
+	diverseReplicas bool,
+	protocol string,
+	tlsOptions *TLSOptions,
+) (*CarbonRouter, error) {
+	if len(destinations) == 0 {
+		return nil, errors.New("no carbon destinations configured")
+	}
+	if replicationFactor < 1 {
+		return nil, fmt.Errorf("invalid replication factor %d", replicationFactor)
+	}
+	ring, err := newConsistentHashRing(hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	router := &CarbonRouter{
+		ring:              ring,
+		replicationFactor: replicationFactor,
+		diverseReplicas:   diverseReplicas,
+	}
+	for _, destination := range destinations {
+		if err := ring.addNode(destination); err != nil {
+			return nil, err
+		}
+		node, err := GraphiteFactoryWithTLS(protocol, destination.Server, destination.Port, "", tlsOptions)
+		if err != nil {
+			router.Disconnect()
+			return nil, fmt.Errorf("%s: %v", net.JoinHostPort(destination.Server, strconv.Itoa(destination.Port)), err)
+		}
+		router.nodes = append(router.nodes, node)
+	}
+	return router, nil
+}
+
+// destinations returns the indexes of the nodes that receive metric
+func (router *CarbonRouter) destinations(metric string) []int {
+	nodes := router.ring.getNodes(metric)
+	if !router.diverseReplicas {
+		return nodes[:min(router.replicationFactor, len(nodes))]
+	}
+
+	selected := make([]int, 0, router.replicationFactor)
+	usedServers := make(map[string]bool)
+	for _, node := range nodes {
+		server := router.ring.nodes[node].Server
+		if usedServers[server] {
+			continue
+		}
+		usedServers[server] = true
+		selected = append(selected, node)
+		if len(selected) >= router.replicationFactor {
+			break
+		}
+	}
+	return selected
+}
+
+// Connect reconnects every destination
+func (router *CarbonRouter) Connect() error {
+	var errs []error
+	for _, node := range router.nodes {
+		errs = append(errs, node.Connect())
+	}
+	return errors.Join(errs...)
+}
+
+// Disconnect closes the connection to every destination
+func (router *CarbonRouter) Disconnect() error {
+	var errs []error
+	for _, node := range router.nodes {
+		errs = append(errs, node.Disconnect())
+	}
+	return errors.Join(errs...)
+}
+
+// SendMetrics groups the metrics by destination and sends every group with
+// the connection of its node
+func (router *CarbonRouter) SendMetrics(metrics []Metric) error {
+	batches := make([][]Metric, len(router.nodes))
+	routes := make(map[string][]int)
+	for _, metric := range metrics {
+		nodes, ok := routes[metric.Name]
+		if !ok {
+			nodes = router.destinations(metric.Name)
+			routes[metric.Name] = nodes
+		}
+		for _, node := range nodes {
+			batches[node] = append(batches[node], metric)
+		}
+	}
+
+	var errs []error
+	for node, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		errs = append(errs, router.nodes[node].SendMetrics(batch))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDestinations(t *testing.T) {
+	t.Parallel()
+
+	destinations, err := parseDestinations("10.0.0.1:2004:a, carbon:2104,[::1]:2204:c")
+	if err != nil {
+		t.Fatalf("parseDestinations() error = %v", err)
+	}
+	expected := []carbonDestination{
+		{Server: "10.0.0.1", Port: 2004, Instance: "a"},
+		{Server: "carbon", Port: 2104},
+		{Server: "::1", Port: 2204, Instance: "c"},
+	}
+	if !slices.Equal(destinations, expected) {
+		t.Errorf("parseDestinations() = %+v, want %+v", destinations, expected)
+	}
+
+	for _, invalid := range []string{"carbon", "carbon:port", "carbon:2004:a:b", "[::1:2004", ":2004"} {
+		if _, err := parseDestinations(invalid); err == nil {
+			t.Errorf("expected error for destination %q", invalid)
+		}
+	}
+}
+
+func TestConsistentHashRing(t *testing.T) {
+	t.Parallel()
+
+	// Expected nodes computed with carbon.hashing.ConsistentHashRing
+	tests := []struct {
+		hashType string
+		key      string
+		want     []int
+	}{
+		{hashTypeCarbon, "servers.web01.cpu.user", []int{1, 0, 2}},
+		{hashTypeCarbon, "carbon.agents.foo.metricsReceived", []int{0, 2, 1}},
+		{hashTypeCarbon, "a.b.c", []int{1, 2, 0}},
+		{hashTypeCarbon, "collectd.host.load", []int{2, 1, 0}},
+		{hashTypeFNV1a, "servers.web01.cpu.user", []int{2, 1, 0}},
+		{hashTypeFNV1a, "carbon.agents.foo.metricsReceived", []int{2, 0, 1}},
+		{hashTypeFNV1a, "a.b.c", []int{0, 1, 2}},
+		{hashTypeFNV1a, "collectd.host.load", []int{0, 1, 2}},
+	}
+
+	rings := make(map[string]*consistentHashRing)
+	for _, hashType := range []string{hashTypeCarbon, hashTypeFNV1a} {
+		ring, err := newConsistentHashRing(hashType)
+		if err != nil {
+			t.Fatalf("newConsistentHashRing() error = %v", err)
+		}
+		for _, destination := range []carbonDestination{
+			{Server: "10.0.0.1", Port: 2004, Instance: "a"},
+			{Server: "10.0.0.1", Port: 2104, Instance: "b"},
+			{Server: "10.0.0.2", Port: 2004, Instance: "c"},
+		} {
+			if err := ring.addNode(destination); err != nil {
+				t.Fatalf("addNode() error = %v", err)
+			}
+		}
+		rings[hashType] = ring
+	}
+
+	for _, tt := range tests {
+		if got := rings[tt.hashType].getNodes(tt.key); !slices.Equal(got, tt.want) {
+			t.Errorf("getNodes(%s, %s) = %v, want %v", tt.hashType, tt.key, got, tt.want)
+		}
+	}
+
+	ring := rings[hashTypeCarbon]
+	if err := ring.addNode(carbonDestination{Server: "10.0.0.1", Port: 2204, Instance: "a"}); err == nil {
+		t.Error("expected error for a duplicate destination instance")
+	}
+	if _, err := newConsistentHashRing("md5"); err == nil {
+		t.Error("expected error for an unknown hash type")
+	}
+}
+
+func TestConsistentHashRingWithoutInstances(t *testing.T) {
+	t.Parallel()
+
+	ring, _ := newConsistentHashRing(hashTypeCarbon)
+	ring.addNode(carbonDestination{Server: "10.0.0.1", Port: 2004})
+	if got := ring.getNodes("a.b.c"); !slices.Equal(got, []int{0}) {
+		t.Errorf("expected the only node for a single destination, got %v", got)
+	}
+
+	ring.addNode(carbonDestination{Server: "10.0.0.2", Port: 2004})
+	if got := ring.getNodes("servers.web01.cpu.user"); !slices.Equal(got, []int{1, 0}) {
+		t.Errorf("getNodes() = %v, want [1 0]", got)
+	}
+
+	// carbon hashes the replicas of a destination without instance as
+	// "<i>-None" with fnv1a_ch, every destination getting the same keys
+	ring, _ = newConsistentHashRing(hashTypeFNV1a)
+	for _, server := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := ring.addNode(carbonDestination{Server: server, Port: 2004}); err != nil {
+			t.Fatalf("addNode() error = %v", err)
+		}
+	}
+	if got := ring.getNodes("a.b.c"); !slices.Equal(got, []int{0, 1, 2}) {
+		t.Errorf("getNodes() with fnv1a_ch = %v, want [0 1 2]", got)
+	}
+	if got := ring.getNodes("servers.web140.cpu.user"); !slices.Equal(got, []int{1, 2, 0}) {
+		t.Errorf("getNodes() with fnv1a_ch = %v, want [1 2 0]", got)
+	}
+}
+
+func TestCarbonRouterDestinations(t *testing.T) {
+	t.Parallel()
+
+	ring, _ := newConsistentHashRing(hashTypeCarbon)
+	ring.addNode(carbonDestination{Server: "10.0.0.1", Port: 2004, Instance: "a"})
+	ring.addNode(carbonDestination{Server: "10.0.0.1", Port: 2104, Instance: "b"})
+	ring.addNode(carbonDestination{Server: "10.0.0.2", Port: 2004, Instance: "c"})
+
+	router := &CarbonRouter{ring: ring, replicationFactor: 2}
+	if got := router.destinations("servers.web01.cpu.user"); !slices.Equal(got, []int{1, 0}) {
+		t.Errorf("destinations() = %v, want [1 0]", got)
+	}
+
+	router.diverseReplicas = true
+	if got := router.destinations("servers.web01.cpu.user"); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("destinations() with diverse replicas = %v, want [1 2]", got)
+	}
+}
+
+// listenCarbon listens for a plaintext connection until the end of the test,
+// sending every line received to received prefixed by the listener address
+func listenCarbon(t *testing.T, received chan<- string) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- listener.Addr().String() + " " + scanner.Text()
+		}
+	}()
+	return listener
+}
+
+func TestCarbonRouterSendMetrics(t *testing.T) {
+	t.Parallel()
+
+	listeners := make([]net.Listener, 2)
+	received := make(chan string, 10)
+	destinations := make([]carbonDestination, 0, len(listeners))
+	for i := range listeners {
+		listener := listenCarbon(t, received)
+		listeners[i] = listener
+		destinations = append(destinations, carbonDestination{
+			Server:   "127.0.0.1",
+			Port:     listener.Addr().(*net.TCPAddr).Port,
+			Instance: string(rune('a' + i)),
+		})
+	}
+
+	router, err := NewCarbonRouter(destinations, hashTypeCarbon, 1, false, "tcp", nil)
+	if err != nil {
+		t.Fatalf("NewCarbonRouter() error = %v", err)
+	}
+	defer router.Disconnect()
+
+	metrics := []Metric{
+		NewMetric("servers.web01.cpu.user", "1", 1234567890),
+		NewMetric("a.b.c", "2", 1234567890),
+		NewMetric("collectd.host.load", "3", 1234567890),
+	}
+	if err := router.SendMetrics(metrics); err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+
+	for range metrics {
+		line := <-received
+		addr, metric, _ := strings.Cut(line, " ")
+		name, _, _ := strings.Cut(metric, " ")
+		expected := listeners[router.destinations(name)[0]].Addr().String()
+		if addr != expected {
+			t.Errorf("metric %s received by %s, want %s", name, addr, expected)
+		}
+	}
+
+	if _, err := NewCarbonRouter(nil, hashTypeCarbon, 1, false, "tcp", nil); err == nil {
+		t.Error("expected error without destinations")
+	}
+	if _, err := NewCarbonRouter(destinations, hashTypeCarbon, 0, false, "tcp", nil); err == nil {
+		t.Error("expected error for an invalid replication factor")
+	}
+}
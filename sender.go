@@ -0,0 +1,11 @@
+package main
+
+// Sender is implemented by the destinations that whisper points are sent to
+type Sender interface {
+	// Connect (re)establishes the connection to the destination
+	Connect() error
+	// Disconnect closes the connection to the destination
+	Disconnect() error
+	// SendMetrics sends the metrics, as a batch, to the destination
+	SendMetrics(metrics []Metric) error
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Worker states reported by the metrics endpoint
+const (
+	workerConnecting int32 = iota
+	workerIdle
+	workerSending
+	workerStopped
+	workerFailed
+)
+
+// workerStateNames names the worker states, indexed by state
+var workerStateNames = []string{"connecting", "idle", "sending", "stopped", "failed"}
+
+// runStats counts the work done by every worker, it is shared by the
+// progress reporter and the metrics endpoint
+type runStats struct {
+	files      atomic.Int64
+	sent       atomic.Int64
+	failed     atomic.Int64
+	skipped    atomic.Int64
+	points     atomic.Int64
+	bytes      atomic.Int64
+	reconnects atomic.Int64
+	workers    []atomic.Int32
+}
+
+func newRunStats(workers int) *runStats {
+	return &runStats{workers: make([]atomic.Int32, workers)}
+}
+
+// fileDone records a file that was sent, or failed with err
+func (stats *runStats) fileDone(err error) {
+	stats.files.Add(1)
+	if err != nil {
+		stats.failed.Add(1)
+	} else {
+		stats.sent.Add(1)
+	}
+}
+
+// fileSkipped records a file that was filtered out or already sent
+func (stats *runStats) fileSkipped() {
+	stats.files.Add(1)
+	stats.skipped.Add(1)
+}
+
+// setWorkerState records the state of the worker with the given id
+func (stats *runStats) setWorkerState(id int, state int32) {
+	stats.workers[id].Store(state)
+}
+
+// statsSender records the points and bytes of every batch confirmed by the
+// wrapped Sender, and the reconnections made when a batch fails
+type statsSender struct {
+	Sender
+	stats *runStats
+}
+
+func (sender *statsSender) Connect() error {
+	sender.stats.reconnects.Add(1)
+	return sender.Sender.Connect()
+}
+
+func (sender *statsSender) SendMetrics(metrics []Metric) error {
+	err := sender.Sender.SendMetrics(metrics)
+	if err == nil {
+		bytes := 0
+		for _, metric := range metrics {
+			bytes += metricLength(metric)
+		}
+		sender.stats.points.Add(int64(len(metrics)))
+		sender.stats.bytes.Add(int64(bytes))
+	}
+	return err
+}
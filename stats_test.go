@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRunStatsFiles(t *testing.T) {
+	t.Parallel()
+
+	stats := newRunStats(2)
+	stats.fileDone(nil)
+	stats.fileDone(errors.New("broken pipe"))
+	stats.fileSkipped()
+	if stats.files.Load() != 3 || stats.sent.Load() != 1 || stats.failed.Load() != 1 || stats.skipped.Load() != 1 {
+		t.Errorf("unexpected file counts: %d files, %d sent, %d failed, %d skipped",
+			stats.files.Load(), stats.sent.Load(), stats.failed.Load(), stats.skipped.Load())
+	}
+
+	stats.setWorkerState(1, workerSending)
+	if stats.workers[0].Load() != workerConnecting || stats.workers[1].Load() != workerSending {
+		t.Errorf("unexpected worker states %d and %d", stats.workers[0].Load(), stats.workers[1].Load())
+	}
+}
+
+func TestStatsSender(t *testing.T) {
+	t.Parallel()
+
+	stats := newRunStats(1)
+	metrics := []Metric{NewMetric("foo", "1", 1700000000), NewMetric("foo.bar", "2.5", 1700000060)}
+
+	nop := NewGraphiteNop("localhost", 2003)
+	nop.DisableLog = true
+	sender := &statsSender{Sender: nop, stats: stats}
+	if err := sender.SendMetrics(metrics); err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+	failing := &statsSender{Sender: &failingSender{}, stats: stats}
+	if err := failing.SendMetrics(metrics); err == nil {
+		t.Error("expected the error of the wrapped sender")
+	}
+	if err := failing.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	if points := stats.points.Load(); points != 2 {
+		t.Errorf("expected only the confirmed points to be counted, got %d", points)
+	}
+	if bytes, want := stats.bytes.Load(), int64(metricLength(metrics[0])+metricLength(metrics[1])); bytes != want {
+		t.Errorf("expected %d bytes, got %d", want, bytes)
+	}
+	if reconnects := stats.reconnects.Load(); reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %d", reconnects)
+	}
+}
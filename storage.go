@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// configSection is a section of a carbon configuration file, with its keys
+// lowercased as carbon reads them
+type configSection struct {
+	name    string
+	options map[string]string
+}
+
+// parseCarbonConfig reads the sections of a carbon configuration file in the
+// order they appear. Comments start with # or ;.
+func parseCarbonConfig(path string) ([]configSection, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sections []configSection
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sections = append(sections, configSection{name: line[1 : len(line)-1], options: map[string]string{}})
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found || len(sections) == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line %q", path, number, line)
+		}
+		sections[len(sections)-1].options[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return sections, scanner.Err()
+}
+
+// storageSchema is a section of storage-schemas.conf
+type storageSchema struct {
+	name       string
+	pattern    *regexp.Regexp
+	retentions whisper.Retentions
+}
+
+// storageAggregation is a section of storage-aggregation.conf, the settings
+// it leaves out are taken from the defaults
+type storageAggregation struct {
+	name         string
+	pattern      *regexp.Regexp
+	aggregation  whisper.AggregationMethod
+	xFilesFactor *float32
+}
+
+// storageRules picks the schema of a new whisper file as carbon does: the
+// retentions come from the first storage-schemas.conf section and the
+// aggregation from the first storage-aggregation.conf section whose pattern
+// matches the metric name. Metrics matched by no section get the defaults.
+type storageRules struct {
+	schemas      []storageSchema
+	aggregations []storageAggregation
+	defaults     whisperSchema
+}
+
+func newStorageRules(defaults whisperSchema) *storageRules {
+	return &storageRules{defaults: defaults}
+}
+
+// compileSectionPattern compiles the pattern of a section
+func compileSectionPattern(section configSection) (*regexp.Regexp, error) {
+	pattern, ok := section.options["pattern"]
+	if !ok {
+		return nil, errors.New("section " + section.name + " has no pattern")
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("section %s: invalid pattern %s: %v", section.name, pattern, err)
+	}
+	return compiled, nil
+}
+
+// loadSchemas reads a carbon storage-schemas.conf file
+func (rules *storageRules) loadSchemas(path string) error {
+	sections, err := parseCarbonConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, section := range sections {
+		pattern, err := compileSectionPattern(section)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		retentions, err := whisper.ParseRetentionDefs(section.options["retentions"])
+		if err != nil {
+			return fmt.Errorf("%s: section %s: invalid retentions %s: %v", path, section.name, section.options["retentions"], err)
+		}
+		rules.schemas = append(rules.schemas, storageSchema{name: section.name, pattern: pattern, retentions: retentions})
+	}
+	return nil
+}
+
+// loadAggregation reads a carbon storage-aggregation.conf file
+func (rules *storageRules) loadAggregation(path string) error {
+	sections, err := parseCarbonConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, section := range sections {
+		pattern, err := compileSectionPattern(section)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		aggregation := storageAggregation{name: section.name, pattern: pattern, aggregation: whisper.Unknown}
+		if method, ok := section.options["aggregationmethod"]; ok {
+			if aggregation.aggregation, err = parseAggregationMethod(method); err != nil {
+				return fmt.Errorf("%s: section %s: %v", path, section.name, err)
+			}
+		}
+		if value, ok := section.options["xfilesfactor"]; ok {
+			xFilesFactor, err := strconv.ParseFloat(value, 32)
+			if err != nil || xFilesFactor < 0 || xFilesFactor > 1 {
+				return fmt.Errorf("%s: section %s: xFilesFactor must be between 0 and 1, got %s", path, section.name, value)
+			}
+			converted := float32(xFilesFactor)
+			aggregation.xFilesFactor = &converted
+		}
+		rules.aggregations = append(rules.aggregations, aggregation)
+	}
+	return nil
+}
+
+// schema returns the schema of the whisper file of a metric
+func (rules *storageRules) schema(metric string) (whisperSchema, error) {
+	schema := rules.defaults
+	for _, section := range rules.schemas {
+		if section.pattern.MatchString(metric) {
+			schema.retentions = section.retentions
+			break
+		}
+	}
+	for _, section := range rules.aggregations {
+		if section.pattern.MatchString(metric) {
+			if section.aggregation != whisper.Unknown {
+				schema.aggregation = section.aggregation
+			}
+			if section.xFilesFactor != nil {
+				schema.xFilesFactor = *section.xFilesFactor
+			}
+			break
+		}
+	}
+	return schema, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "storage.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+func TestParseCarbonConfig(t *testing.T) {
+	t.Parallel()
+
+	sections, err := parseCarbonConfig(writeConfig(t, `# Schema definitions
+[carbon]
+Pattern = ^carbon\.
+retentions = 60:90d
+
+; default
+[default_1min_for_1day]
+pattern = .*
+retentions = 60s:1d
+`))
+	if err != nil {
+		t.Fatalf("parseCarbonConfig() error = %v", err)
+	}
+	if len(sections) != 2 || sections[0].name != "carbon" || sections[0].options["pattern"] != `^carbon\.` || sections[1].options["retentions"] != "60s:1d" {
+		t.Errorf("unexpected sections %+v", sections)
+	}
+
+	for _, content := range []string{"pattern = .*\n", "[carbon]\npattern\n"} {
+		if _, err := parseCarbonConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("parseCarbonConfig(%q) expected an error", content)
+		}
+	}
+	if _, err := parseCarbonConfig(filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestStorageRulesSchema(t *testing.T) {
+	t.Parallel()
+
+	defaults, err := newWhisperSchema("60s:1d", "average", 0.5)
+	if err != nil {
+		t.Fatalf("newWhisperSchema() error = %v", err)
+	}
+	rules := newStorageRules(defaults)
+	if err := rules.loadSchemas(writeConfig(t, `[carbon]
+pattern = ^carbon\.
+retentions = 60:90d
+
+[collectd]
+pattern = ^collectd\.
+retentions = 10s:6h,1m:7d,10m:5y
+`)); err != nil {
+		t.Fatalf("loadSchemas() error = %v", err)
+	}
+	if err := rules.loadAggregation(writeConfig(t, `[min]
+pattern = \.min$
+xFilesFactor = 0.1
+aggregationMethod = min
+
+[count]
+pattern = \.count$
+aggregationMethod = sum
+
+[lower]
+pattern = \.lower$
+xFilesFactor = 0
+`)); err != nil {
+		t.Fatalf("loadAggregation() error = %v", err)
+	}
+
+	tests := []struct {
+		metric       string
+		points       []int
+		aggregation  whisper.AggregationMethod
+		xFilesFactor float32
+	}{
+		{"carbon.agents.cpu", []int{129600}, whisper.Average, 0.5},
+		{"collectd.web01.load.min", []int{2160, 10080, 262800}, whisper.Min, 0.1},
+		{"servers.web01.requests.count", []int{1440}, whisper.Sum, 0.5},
+		{"servers.web01.latency.lower", []int{1440}, whisper.Average, 0},
+		{"cpu.user;host=collectd.min", []int{1440}, whisper.Min, 0.1},
+	}
+
+	for _, tt := range tests {
+		schema, err := rules.schema(tt.metric)
+		if err != nil {
+			t.Errorf("schema(%q) error = %v", tt.metric, err)
+			continue
+		}
+		points := make([]int, 0, len(schema.retentions))
+		for _, retention := range schema.retentions {
+			points = append(points, retention.NumberOfPoints())
+		}
+		if !slices.Equal(points, tt.points) {
+			t.Errorf("schema(%q) retentions = %v, want %v points", tt.metric, schema.retentions, tt.points)
+		}
+		if schema.aggregation != tt.aggregation || schema.xFilesFactor != tt.xFilesFactor {
+			t.Errorf("schema(%q) = %v %v, want %v %v", tt.metric, schema.aggregation, schema.xFilesFactor, tt.aggregation, tt.xFilesFactor)
+		}
+	}
+}
+
+func TestStorageRulesInvalid(t *testing.T) {
+	t.Parallel()
+
+	schemas := []string{
+		"[nopattern]\nretentions = 60:90d\n",
+		"[badpattern]\npattern = ^carbon\\.(\nretentions = 60:90d\n",
+		"[noretentions]\npattern = .*\n",
+		"[badretentions]\npattern = .*\nretentions = 60\n",
+	}
+	for _, content := range schemas {
+		if err := newStorageRules(whisperSchema{}).loadSchemas(writeConfig(t, content)); err == nil {
+			t.Errorf("loadSchemas(%q) expected an error", content)
+		}
+	}
+
+	aggregations := []string{
+		"[nopattern]\naggregationMethod = sum\n",
+		"[badmethod]\npattern = .*\naggregationMethod = median\n",
+		"[badxff]\npattern = .*\nxFilesFactor = 2\n",
+		"[notanumber]\npattern = .*\nxFilesFactor = half\n",
+	}
+	for _, content := range aggregations {
+		if err := newStorageRules(whisperSchema{}).loadAggregation(writeConfig(t, content)); err == nil {
+			t.Errorf("loadAggregation(%q) expected an error", content)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pathTemplate maps the nodes of a dotted metric path to roles, in the
+// "[filter] template [tag=value,...]" form of the InfluxDB graphite templates.
+// Every node of the template names the role of the path node at the same
+// position: an empty node drops it, a role ending with * takes all the
+// remaining nodes and repeated roles are joined with dots.
+type pathTemplate struct {
+	filter *regexp.Regexp
+	nodes  []string
+	tags   map[string]string
+}
+
+// parsePathTemplate parses a template line. The filter is a Graphite glob and
+// the static tags are added to every metric matching the template.
+func parsePathTemplate(line string) (*pathTemplate, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, errors.New("invalid template: " + line)
+	}
+
+	fields, tags, err := cutTemplateTags(fields, line)
+	if err != nil {
+		return nil, err
+	}
+	template := &pathTemplate{tags: tags}
+	if len(fields) == 2 {
+		filter, err := compileGlob(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		template.filter = filter
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return nil, errors.New("invalid template: " + line)
+	}
+
+	template.nodes = strings.Split(fields[0], ".")
+	for _, node := range template.nodes[:len(template.nodes)-1] {
+		if strings.HasSuffix(node, "*") {
+			return nil, errors.New("only the last node can be greedy in template: " + line)
+		}
+	}
+	return template, nil
+}
+
+// cutTemplateTags removes the key=value,... static tags, when present, from
+// the fields of a template and parses them
+func cutTemplateTags(fields []string, line string) ([]string, map[string]string, error) {
+	tags := make(map[string]string)
+	last := fields[len(fields)-1]
+	if len(fields) == 1 || !strings.Contains(last, "=") {
+		return fields, tags, nil
+	}
+	for _, tag := range strings.Split(last, ",") {
+		key, value, found := strings.Cut(tag, "=")
+		if !found || key == "" || value == "" {
+			return nil, nil, errors.New("invalid tag " + tag + " in template: " + line)
+		}
+		tags[key] = value
+	}
+	return fields[:len(fields)-1], tags, nil
+}
+
+// loadPathTemplates parses the templates of a file, one per line. Empty lines
+// and lines starting with # are ignored.
+func loadPathTemplates(path string) ([]*pathTemplate, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var templates []*pathTemplate
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		template, err := parsePathTemplate(line)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, scanner.Err()
+}
+
+// matches reports whether the template applies to the metric path
+func (template *pathTemplate) matches(path string) bool {
+	return template.filter == nil || template.filter.MatchString(path)
+}
+
+// apply returns the dotted values of every role for the metric path,
+// including the static tags that were not set from the path
+func (template *pathTemplate) apply(path string) map[string]string {
+	parts := strings.Split(path, ".")
+	values := make(map[string][]string)
+	for i, role := range template.nodes {
+		if i >= len(parts) {
+			break
+		}
+		if role == "" {
+			continue
+		}
+		if key, greedy := strings.CutSuffix(role, "*"); greedy {
+			values[key] = append(values[key], parts[i:]...)
+			break
+		}
+		values[role] = append(values[role], parts[i])
+	}
+
+	roles := make(map[string]string, len(values)+len(template.tags))
+	for key, value := range template.tags {
+		roles[key] = value
+	}
+	for role, nodes := range values {
+		roles[role] = strings.Join(nodes, ".")
+	}
+	return roles
+}
+
+// matchTemplate returns the first template that applies to the metric path
+func matchTemplate(templates []*pathTemplate, path string) *pathTemplate {
+	for _, template := range templates {
+		if template.matches(path) {
+			return template
+		}
+	}
+	return nil
+}
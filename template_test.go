@@ -0,0 +1,66 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	t.Parallel()
+
+	template, err := parsePathTemplate("servers.* .host.name* dc=eu,env=prod")
+	if err != nil {
+		t.Fatalf("parsePathTemplate() error = %v", err)
+	}
+	if template.filter == nil || !template.matches("servers.web01.cpu.user") || template.matches("collectd.web01.cpu") {
+		t.Error("expected the template to apply to the servers namespace only")
+	}
+	expected := map[string]string{"host": "web01", "name": "cpu.user", "dc": "eu", "env": "prod"}
+	if got := template.apply("servers.web01.cpu.user"); !maps.Equal(got, expected) {
+		t.Errorf("apply() = %v, want %v", got, expected)
+	}
+
+	template, err = parsePathTemplate("region.host.name.name")
+	if err != nil {
+		t.Fatalf("parsePathTemplate() error = %v", err)
+	}
+	if !template.matches("anything") {
+		t.Error("expected a template without filter to apply to every metric")
+	}
+	expected = map[string]string{"region": "eu", "host": "web01", "name": "cpu.user"}
+	if got := template.apply("eu.web01.cpu.user.extra"); !maps.Equal(got, expected) {
+		t.Errorf("apply() = %v, want %v", got, expected)
+	}
+	expected = map[string]string{"region": "eu"}
+	if got := template.apply("eu"); !maps.Equal(got, expected) {
+		t.Errorf("apply() on a short path = %v, want %v", got, expected)
+	}
+}
+
+func TestParsePathTemplateInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, invalid := range []string{"", "a b c d", "name*.host", "servers.* name* dc", "x{ name", "name tag="} {
+		if _, err := parsePathTemplate(invalid); err == nil {
+			t.Errorf("expected error for template %q", invalid)
+		}
+	}
+}
+
+func TestMatchTemplate(t *testing.T) {
+	t.Parallel()
+
+	first, _ := parsePathTemplate("servers.*.cpu .host..name*")
+	second, _ := parsePathTemplate(".host.name*")
+	templates := []*pathTemplate{first, second}
+
+	if got := matchTemplate(templates, "servers.web01.cpu.user"); got != first {
+		t.Error("expected the first matching template")
+	}
+	if got := matchTemplate(templates, "servers.web01.memory.used"); got != second {
+		t.Error("expected the fallback template")
+	}
+	if got := matchTemplate(nil, "servers.web01.memory.used"); got != nil {
+		t.Error("expected no template")
+	}
+}
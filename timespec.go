@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// absoluteTimeLayouts are the layouts accepted for absolute times, the ones
+// without a zone are read in the zone of the reference time
+var absoluteTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// offsetPart matches one amount and unit of a Graphite-style time offset
+var offsetPart = regexp.MustCompile(`^(\d+)([a-z]+)`)
+
+// offsetUnit returns the duration of a Graphite time offset unit, matched by
+// prefix as graphite-web does
+func offsetUnit(unit string) (time.Duration, error) {
+	day := 24 * time.Hour
+	switch {
+	case strings.HasPrefix(unit, "s"):
+		return time.Second, nil
+	case strings.HasPrefix(unit, "mon"):
+		return 30 * day, nil
+	case strings.HasPrefix(unit, "m"):
+		return time.Minute, nil
+	case strings.HasPrefix(unit, "h"):
+		return time.Hour, nil
+	case strings.HasPrefix(unit, "d"):
+		return day, nil
+	case strings.HasPrefix(unit, "w"):
+		return 7 * day, nil
+	case strings.HasPrefix(unit, "y"):
+		return 365 * day, nil
+	}
+	return 0, errors.New("invalid time unit " + unit)
+}
+
+// parseTimeOffset parses a Graphite-style offset such as -30d, +1h or
+// -1d12h into a duration
+func parseTimeOffset(offset string) (time.Duration, error) {
+	sign := time.Duration(1)
+	switch {
+	case strings.HasPrefix(offset, "-"):
+		sign = -1
+		offset = offset[1:]
+	case strings.HasPrefix(offset, "+"):
+		offset = offset[1:]
+	}
+	if offset == "" {
+		return 0, errors.New("empty time offset")
+	}
+
+	var total time.Duration
+	for offset != "" {
+		match := offsetPart.FindStringSubmatch(offset)
+		if match == nil {
+			return 0, errors.New("invalid time offset " + offset)
+		}
+		amount, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+		unit, err := offsetUnit(match[2])
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(amount) * unit
+		offset = offset[len(match[0]):]
+	}
+	return sign * total, nil
+}
+
+// parseTime parses the -from and -to values into a unix timestamp. It accepts
+// unix timestamps, RFC3339 times, dates with an optional time, "now" and
+// Graphite-style offsets from now such as -30d or now-6h.
+func parseTime(value string, now time.Time) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if timestamp, err := strconv.Atoi(value); err == nil {
+		return timestamp, nil
+	}
+
+	if offset, ok := strings.CutPrefix(value, "now"); ok {
+		if offset == "" {
+			return int(now.Unix()), nil
+		}
+		value = offset
+	}
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		offset, err := parseTimeOffset(value)
+		if err != nil {
+			return 0, err
+		}
+		return int(now.Add(offset).Unix()), nil
+	}
+
+	for _, layout := range absoluteTimeLayouts {
+		if parsed, err := time.ParseInLocation(layout, strings.ToUpper(value), now.Location()); err == nil {
+			return int(parsed.Unix()), nil
+		}
+	}
+	return 0, errors.New("invalid time " + value + ", use a unix timestamp, RFC3339, YYYY-MM-DD [HH:MM[:SS]], now or an offset such as -30d")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"now", now},
+		{"NOW", now},
+		{"-30d", now.AddDate(0, 0, -30)},
+		{"-6h", now.Add(-6 * time.Hour)},
+		{"now-1d12h", now.Add(-36 * time.Hour)},
+		{"+15min", now.Add(15 * time.Minute)},
+		{"-5m", now.Add(-5 * time.Minute)},
+		{"-2mon", now.AddDate(0, 0, -60)},
+		{"-1w", now.AddDate(0, 0, -7)},
+		{"-1y", now.AddDate(0, 0, -365)},
+		{"-10seconds", now.Add(-10 * time.Second)},
+		{"2026-09-01", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{"2026-09-01 08:15", time.Date(2026, 9, 1, 8, 15, 0, 0, time.UTC)},
+		{"2026-09-01T08:15:30", time.Date(2026, 9, 1, 8, 15, 30, 0, time.UTC)},
+		{"2026-09-01T08:15:30+02:00", time.Date(2026, 9, 1, 6, 15, 30, 0, time.UTC)},
+		{"1234567890", time.Unix(1234567890, 0)},
+		{"0", time.Unix(0, 0)},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTime(tt.value, now)
+		if err != nil {
+			t.Errorf("parseTime(%q) error = %v", tt.value, err)
+			continue
+		}
+		if int64(got) != tt.want.Unix() {
+			t.Errorf("parseTime(%q) = %v, want %v", tt.value, time.Unix(int64(got), 0).UTC(), tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "yesterday", "-", "-30x", "now-", "2026-13-01", "-1d-2h"} {
+		if _, err := parseTime(invalid, now); err == nil {
+			t.Errorf("expected error for time %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// TLSOptions defines the TLS settings of a graphite connection
+type TLSOptions struct {
+	// CAFile is a PEM bundle used to verify the server, the system roots are
+	// used when empty
+	CAFile string
+	// CertFile and KeyFile hold the client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used for SNI and verification, the host
+	// is used when empty
+	ServerName string
+	// InsecureSkipVerify disables the verification of the server certificate
+	InsecureSkipVerify bool
+}
+
+// config builds the tls.Config used to connect to host
+func (options *TLSOptions) config(host string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         host,
+		InsecureSkipVerify: options.InsecureSkipVerify, // #nosec G402 -- explicitly requested escape hatch
+	}
+	if options.ServerName != "" {
+		config.ServerName = options.ServerName
+	}
+
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(options.CAFile))
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + options.CAFile)
+		}
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, errors.New("both a client certificate and a key are required for mutual TLS")
+		}
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate issues a certificate signed by parent (self-signed when
+// parent is nil) and writes it and its key as PEM files in dir
+func writeCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPem, 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certificate, key
+}
+
+func TestConnectTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCertificate(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeCertificate(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "carbon.example"},
+		DNSNames:     []string{"carbon.example"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCertificate(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCertificate, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatalf("failed to load server certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil {
+					received <- line
+				}
+			}()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	options := &TLSOptions{
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		ServerName: "carbon.example",
+	}
+	g, err := GraphiteFactoryWithTLS("tcp", "127.0.0.1", port, "", options)
+	if err != nil {
+		t.Fatalf("GraphiteFactoryWithTLS() error = %v", err)
+	}
+	defer g.Disconnect()
+
+	if err := g.SendMetric(NewMetric("test.metric", "10", 1234567890)); err != nil {
+		t.Fatalf("SendMetric() over TLS error = %v", err)
+	}
+	if line := <-received; line != "test.metric 10 1234567890\n" {
+		t.Errorf("unexpected line received over TLS: %q", line)
+	}
+
+	// Without the server name the certificate does not match 127.0.0.1
+	options = &TLSOptions{CAFile: filepath.Join(dir, "ca.pem")}
+	if _, err := GraphiteFactoryWithTLS("tcp", "127.0.0.1", port, "", options); err == nil {
+		t.Error("expected verification error without the server name override")
+	}
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	t.Parallel()
+
+	config, err := (&TLSOptions{InsecureSkipVerify: true}).config("carbon.example")
+	if err != nil {
+		t.Fatalf("config() error = %v", err)
+	}
+	if config.ServerName != "carbon.example" || !config.InsecureSkipVerify {
+		t.Errorf("unexpected config: server name %q, insecure %v", config.ServerName, config.InsecureSkipVerify)
+	}
+
+	if _, err := (&TLSOptions{CertFile: "client.pem"}).config("carbon.example"); err == nil {
+		t.Error("expected error for a client certificate without a key")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+	if _, err := (&TLSOptions{CAFile: caFile}).config("carbon.example"); err == nil || !strings.Contains(err.Error(), "no certificates") {
+		t.Errorf("expected error for an invalid CA bundle, got %v", err)
+	}
+
+	g := &Graphite{Host: "localhost", Port: 2003, Protocol: "udp", TLS: &TLSOptions{}}
+	if err := g.Connect(); err == nil {
+		t.Error("expected error for TLS over UDP")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+// whisperSchema describes how a new whisper file is created
+type whisperSchema struct {
+	retentions   whisper.Retentions
+	aggregation  whisper.AggregationMethod
+	xFilesFactor float32
+}
+
+// parseAggregationMethod parses one of the aggregation methods of carbon
+func parseAggregationMethod(method string) (whisper.AggregationMethod, error) {
+	switch aggregation := whisper.ParseAggregationMethod(method); aggregation {
+	case whisper.Average, whisper.Sum, whisper.Last, whisper.Max, whisper.Min, whisper.First:
+		return aggregation, nil
+	}
+	return whisper.Unknown, errors.New("aggregation method " + method + " not supported, use average/sum/last/max/min/first")
+}
+
+// newWhisperSchema parses a retention definition such as 1m:30d,1h:1y, an
+// aggregation method and an xFilesFactor between 0 and 1
+func newWhisperSchema(retentions string, aggregation string, xFilesFactor float64) (whisperSchema, error) {
+	parsed, err := whisper.ParseRetentionDefs(retentions)
+	if err != nil {
+		return whisperSchema{}, fmt.Errorf("invalid retentions %s: %v", retentions, err)
+	}
+	method, err := parseAggregationMethod(aggregation)
+	if err != nil {
+		return whisperSchema{}, err
+	}
+	if xFilesFactor < 0 || xFilesFactor > 1 {
+		return whisperSchema{}, errors.New("xFilesFactor must be between 0 and 1, got " + strconv.FormatFloat(xFilesFactor, 'g', -1, 64))
+	}
+	return whisperSchema{
+		retentions:   parsed,
+		aggregation:  method,
+		xFilesFactor: float32(xFilesFactor),
+	}, nil
+}
+
+// metricPath returns the path of the whisper file of a metric relative to
+// the root of the tree, as carbon lays it out. Tagged series are stored under
+// _tagged/<hash[0:3]>/<hash[3:6]>/ with the dots of their name encoded as
+// _DOT_, which decodeTaggedPath reads back.
+func metricPath(metric string) string {
+	if strings.Contains(metric, ";") {
+		sum := sha256.Sum256([]byte(metric))
+		hash := hex.EncodeToString(sum[:])
+		return filepath.Join(taggedDirectory, hash[0:3], hash[3:6], strings.ReplaceAll(metric, ".", "_DOT_")+".wsp")
+	}
+	return filepath.Join(strings.Split(metric, ".")...) + ".wsp"
+}
+
+// WhisperWriter is a Sender writing the metrics into whisper files below
+// Directory instead of sending them over the network. Missing files are
+// created with the schema returned by Schema for their metric, existing files
+// keep their own retentions.
+type WhisperWriter struct {
+	Directory string
+	Schema    func(metric string) (whisperSchema, error)
+
+	// The file of the last metric written stays open, as the batches of a
+	// whisper file come one after the other
+	file   *whisper.Whisper
+	metric string
+}
+
+// NewWhisperWriter returns a WhisperWriter creating the missing files with
+// schema
+func NewWhisperWriter(directory string, schema func(metric string) (whisperSchema, error)) (*WhisperWriter, error) {
+	if directory == "" {
+		return nil, errors.New("an output directory is required to write whisper files")
+	}
+	return &WhisperWriter{Directory: directory, Schema: schema}, nil
+}
+
+// Connect has nothing to establish, the files are opened when written
+func (writer *WhisperWriter) Connect() error {
+	return nil
+}
+
+// Disconnect closes the open whisper file
+func (writer *WhisperWriter) Disconnect() error {
+	if writer.file == nil {
+		return nil
+	}
+	err := writer.file.Close()
+	writer.file = nil
+	writer.metric = ""
+	return err
+}
+
+// open returns the whisper file of a metric, creating it if needed
+func (writer *WhisperWriter) open(metric string) (*whisper.Whisper, error) {
+	if writer.file != nil && writer.metric == metric {
+		return writer.file, nil
+	}
+	if err := writer.Disconnect(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(writer.Directory, metricPath(metric))
+	if relative, err := filepath.Rel(writer.Directory, path); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return nil, errors.New("metric " + metric + " is outside of the output directory")
+	}
+
+	var file *whisper.Whisper
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		file, err = whisper.Open(path)
+	case errors.Is(err, os.ErrNotExist):
+		file, err = writer.create(path, metric)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	writer.file = file
+	writer.metric = metric
+	return file, nil
+}
+
+// create creates the whisper file of a metric with the schema matching it
+func (writer *WhisperWriter) create(path string, metric string) (*whisper.Whisper, error) {
+	schema, err := writer.Schema(metric)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	return whisper.Create(path, schema.retentions, schema.aggregation, schema.xFilesFactor)
+}
+
+// metricPoints are the points of one metric in a batch
+type metricPoints struct {
+	name   string
+	points []*whisper.TimeSeriesPoint
+}
+
+// groupMetrics groups the points of a batch by metric, in the order the
+// metrics first appear. The points of a metric keep their order, so that the
+// last of the points sharing a timestamp is still the one written.
+func groupMetrics(metrics []Metric) ([]metricPoints, error) {
+	groups := make([]metricPoints, 0, 1)
+	positions := make(map[string]int)
+	for _, metric := range metrics {
+		value, err := strconv.ParseFloat(metric.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %v", metric.Value, metric.Name, err)
+		}
+		position, ok := positions[metric.Name]
+		if !ok {
+			position = len(groups)
+			positions[metric.Name] = position
+			groups = append(groups, metricPoints{name: metric.Name})
+		}
+		groups[position].points = append(groups[position].points, &whisper.TimeSeriesPoint{Time: int(metric.Timestamp), Value: value})
+	}
+	return groups, nil
+}
+
+// SendMetrics writes the points of every metric to its whisper file, older
+// points than the retention of the file are dropped by whisper. The batches
+// of split archives interleave several metrics, their points are grouped so
+// that each file is opened and updated once per batch.
+func (writer *WhisperWriter) SendMetrics(metrics []Metric) error {
+	groups, err := groupMetrics(metrics)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		file, err := writer.open(group.name)
+		if err != nil {
+			return err
+		}
+		if err := file.UpdateMany(group.points); err != nil {
+			return err
+		}
+	}
+	return nil
+}
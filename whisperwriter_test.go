@@ -0,0 +1,209 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+)
+
+func TestNewWhisperSchema(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		retentions   string
+		aggregation  string
+		xFilesFactor float64
+		wantErr      bool
+	}{
+		{"1m:30d,1h:1y", "average", 0.5, false},
+		{"10s:6h", "max", 0, false},
+		{"60:1440", "last", 1, false},
+		{"1m", "average", 0.5, true},
+		{"1m:30d", "median", 0.5, true},
+		{"1m:30d", "mix", 0.5, true},
+		{"1m:30d", "sum", 1.5, true},
+		{"1m:30d", "sum", -0.1, true},
+	}
+
+	for _, tt := range tests {
+		schema, err := newWhisperSchema(tt.retentions, tt.aggregation, tt.xFilesFactor)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newWhisperSchema(%q, %q, %v) error = %v, wantErr %v", tt.retentions, tt.aggregation, tt.xFilesFactor, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (len(schema.retentions) == 0 || schema.xFilesFactor != float32(tt.xFilesFactor)) {
+			t.Errorf("newWhisperSchema(%q, %q, %v) = %+v", tt.retentions, tt.aggregation, tt.xFilesFactor, schema)
+		}
+	}
+}
+
+func TestMetricPath(t *testing.T) {
+	t.Parallel()
+
+	baseDir := t.TempDir()
+	tests := []string{
+		"foo",
+		"servers.web01.cpu.user",
+		"cpu.user;host=web01;dc=eu.west",
+	}
+
+	for _, metric := range tests {
+		path := metricPath(metric)
+		got, err := convertFilename(filepath.Join(baseDir, path), baseDir)
+		if err != nil {
+			t.Errorf("convertFilename(%q) error = %v", path, err)
+		}
+		if got != metric {
+			t.Errorf("metricPath(%q) = %q, read back as %q", metric, path, got)
+		}
+	}
+	if got := metricPath("servers.web01.cpu"); got != filepath.Join("servers", "web01", "cpu.wsp") {
+		t.Errorf("metricPath() = %q", got)
+	}
+}
+
+// newTestWhisperWriter returns a writer creating every file below outputDir
+// with the same schema
+func newTestWhisperWriter(t *testing.T, outputDir string, retentions string, aggregation string, xFilesFactor float64) *WhisperWriter {
+	t.Helper()
+
+	schema, err := newWhisperSchema(retentions, aggregation, xFilesFactor)
+	if err != nil {
+		t.Fatalf("newWhisperSchema() error = %v", err)
+	}
+	writer, err := NewWhisperWriter(outputDir, func(string) (whisperSchema, error) {
+		return schema, nil
+	})
+	if err != nil {
+		t.Fatalf("NewWhisperWriter() error = %v", err)
+	}
+	return writer
+}
+
+func TestWhisperWriterSendMetrics(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Unix()
+	first := now - now%60 - 300
+	outputDir := t.TempDir()
+	writer := newTestWhisperWriter(t, outputDir, "1m:1h,5m:1d", "sum", 0)
+
+	metrics := []Metric{
+		{Name: "foo.bar", Value: "1", Timestamp: first},
+		{Name: "foo.bar", Value: "2", Timestamp: first + 60},
+		{Name: "foo.baz", Value: "3", Timestamp: first},
+		{Name: "foo.bar", Value: "4", Timestamp: first + 120},
+	}
+	if err := writer.SendMetrics(metrics); err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+	if err := writer.Disconnect(); err != nil {
+		t.Fatalf("Disconnect() error = %v", err)
+	}
+
+	path := filepath.Join(outputDir, "foo", "bar.wsp")
+	file := openTestWhisperFile(t, path)
+	if file.AggregationMethod() != whisper.Sum || len(file.Retentions()) != 2 {
+		t.Errorf("unexpected schema %v %v", file.AggregationMethod(), file.Retentions())
+	}
+	if values := fetchValues(t, path, int(first)-1, int(first)+120); !slices.Equal(values, []float64{1, 2, 4}) {
+		t.Errorf("unexpected values %v", values)
+	}
+	// The coarser archive is filled by whisper
+	values := fetchValues(t, path, int(first)-7200, int(first)+120)
+	total := 0.0
+	for _, value := range values {
+		if !math.IsNaN(value) {
+			total += value
+		}
+	}
+	if total != 7 {
+		t.Errorf("expected the 5m archive to sum to 7, got %v", values)
+	}
+
+	if _, err := os.Stat(filepath.Join(outputDir, "foo", "baz.wsp")); err != nil {
+		t.Errorf("expected foo.baz to be written: %v", err)
+	}
+}
+
+func TestGroupMetrics(t *testing.T) {
+	t.Parallel()
+
+	// The metrics of split archives come interleaved in timestamp order
+	groups, err := groupMetrics([]Metric{
+		{Name: "foo", Value: "1", Timestamp: 60},
+		{Name: "foo.10m", Value: "2", Timestamp: 60},
+		{Name: "foo", Value: "3", Timestamp: 120},
+		{Name: "foo.1h", Value: "4", Timestamp: 120},
+		{Name: "foo", Value: "5", Timestamp: 120},
+	})
+	if err != nil {
+		t.Fatalf("groupMetrics() error = %v", err)
+	}
+	want := []metricPoints{
+		{name: "foo", points: []*whisper.TimeSeriesPoint{{Time: 60, Value: 1}, {Time: 120, Value: 3}, {Time: 120, Value: 5}}},
+		{name: "foo.10m", points: []*whisper.TimeSeriesPoint{{Time: 60, Value: 2}}},
+		{name: "foo.1h", points: []*whisper.TimeSeriesPoint{{Time: 120, Value: 4}}},
+	}
+	equal := func(a, b metricPoints) bool {
+		return a.name == b.name && slices.EqualFunc(a.points, b.points, func(p, q *whisper.TimeSeriesPoint) bool { return *p == *q })
+	}
+	if !slices.EqualFunc(groups, want, equal) {
+		t.Errorf("expected one group per metric in order of appearance, got %+v", groups)
+	}
+}
+
+func TestWhisperWriterErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewWhisperWriter("", nil); err == nil {
+		t.Error("expected an error without an output directory")
+	}
+
+	writer := newTestWhisperWriter(t, t.TempDir(), "1m:1h", "average", 0.5)
+	defer writer.Disconnect()
+	if err := writer.SendMetrics([]Metric{{Name: "foo", Value: "bar", Timestamp: time.Now().Unix()}}); err == nil {
+		t.Error("expected an error for an invalid value")
+	}
+}
+
+func TestSendWhisperDataToWhisper(t *testing.T) {
+	t.Parallel()
+
+	now := int(time.Now().Unix())
+	first := now - now%60 - 180
+	baseDir := t.TempDir()
+	path := filepath.Join(baseDir, "foo", "bar.wsp")
+	createWhisperFile(t, path, "1m:1h", []*whisper.TimeSeriesPoint{
+		{Time: first, Value: 1},
+		{Time: first + 60, Value: 2},
+		{Time: first + 120, Value: 3},
+	})
+
+	outputDir := t.TempDir()
+	writer := newTestWhisperWriter(t, outputDir, "1m:1d", "average", 0.5)
+	j, err := newJournal("", false, false)
+	if err != nil {
+		t.Fatalf("newJournal() error = %v", err)
+	}
+	selection := archiveSelection{mode: archivesFetch, index: -1}
+	if err := sendWhisperData(path, testRoots(baseDir), writer, 0, 2147483647, selection, batchSize{points: 10000}, 1, newRateLimiter(0, 0, time.Second), j, &metricRewriter{}, &fileReport{}); err != nil {
+		t.Fatalf("sendWhisperData() error = %v", err)
+	}
+	if err := writer.Disconnect(); err != nil {
+		t.Fatalf("Disconnect() error = %v", err)
+	}
+
+	output := filepath.Join(outputDir, "foo", "bar.wsp")
+	if retentions := openTestWhisperFile(t, output).Retentions(); len(retentions) != 1 || retentions[0].NumberOfPoints() != 1440 {
+		t.Errorf("expected the new retentions, got %v", retentions)
+	}
+	if values := fetchValues(t, output, first-1, first+120); !slices.Equal(values, []float64{1, 2, 3}) {
+		t.Errorf("unexpected values %v", values)
+	}
+}